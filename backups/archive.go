@@ -0,0 +1,142 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package backups
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/pufferpanel/pufferd/commons"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//Name of the manifest stored at the start of every archive
+const manifestEntry = ".pufferd-backup.json"
+
+//Writes a gzipped tar of everything in the source folder, starting with the manifest
+func writeArchive(source string, target io.Writer, manifest []byte) (err error) {
+	gz := gzip.NewWriter(target)
+	defer func() {
+		if cErr := gz.Close(); err == nil {
+			err = cErr
+		}
+	}()
+	tw := tar.NewWriter(gz)
+	defer func() {
+		if cErr := tw.Close(); err == nil {
+			err = cErr
+		}
+	}()
+
+	err = tw.WriteHeader(&tar.Header{Name: manifestEntry, Mode: 0644, Size: int64(len(manifest)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return
+	}
+	if _, err = tw.Write(manifest); err != nil {
+		return
+	}
+
+	return filepath.Walk(source, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(source, file)
+		if err != nil || name == "." {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		link := ""
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		case info.IsDir(), info.Mode().IsRegular():
+		default:
+			//sockets, pipes and devices cannot be restored, so are left out
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, header.Size)
+		return err
+	})
+}
+
+//Extracts the entries of a gzipped tar accepted by the filter into the target folder.
+//Entries may not leave the folder, either by their name or through a symlink.
+func extractArchive(source io.Reader, target string, filter func(name string) bool) (count int, err error) {
+	gz, err := gzip.NewReader(source)
+	if err != nil {
+		return
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		name := commons.CleanArchiveName(header.Name, 0)
+		if name == manifestEntry || name == "" {
+			continue
+		}
+		if filter != nil && !filter(name) {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeRegA, tar.TypeSymlink:
+		default:
+			continue
+		}
+		entry := commons.ArchiveEntry{Name: name, Mode: header.FileInfo().Mode(), Link: header.Linkname, ModTime: header.ModTime}
+		if err = commons.WriteArchiveEntry(target, entry, tr); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
@@ -0,0 +1,614 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package backups
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/config"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/programs"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Describes a backup, stored next to the archive and at the start of it
+type Manifest struct {
+	Id       string                 `json:"id"`
+	Server   string                 `json:"server"`
+	Template string                 `json:"template,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	Created  int64                  `json:"created"`
+	//Size of the archive, or of the chunks the snapshot added to the store
+	Size   int64  `json:"size"`
+	Format string `json:"format,omitempty"`
+}
+
+const (
+	//A gzipped tar of every file
+	FormatArchive = "archive"
+	//An index of files stored as deduplicated chunks, shared with the other snapshots of the server
+	FormatSnapshot = "snapshot"
+)
+
+//How the server is prepared before a backup is taken
+type Options struct {
+	//Stops the server for the backup, starting it again after
+	Stop bool `json:"stop,omitempty"`
+	//Console command sent first so the server writes everything to disk, such as save-all
+	SaveCommand string `json:"saveCommand,omitempty"`
+	//Stores only the data which changed since the last snapshot
+	Incremental bool `json:"incremental,omitempty"`
+}
+
+var ErrBackupRunning = errors.New("a backup or restore is already running for this server")
+var ErrNoBackup = errors.New("no backup with given id")
+var ErrNoFile = errors.New("no file with given path in backup")
+
+var busy = make(map[string]bool)
+var busyLocker sync.Mutex
+
+func GetFolder() string {
+	return config.GetStringOrDefault("backupFolder", common.JoinPath("data", "backups"))
+}
+
+//Backs up the root directory of the server.
+//If async is set this returns as soon as the backup has an id, and failures are only reported to the console.
+func Create(server programs.Program, options Options, async bool) (manifest Manifest, err error) {
+	err = begin(server.Id())
+	if err != nil {
+		return
+	}
+
+	data := make(map[string]interface{})
+	for k, v := range server.GetData() {
+		data[k] = v.Value
+	}
+
+	manifest = Manifest{
+		Id:       uuid.NewV4().String(),
+		Server:   server.Id(),
+		Template: server.GetTemplate(),
+		Data:     data,
+		Created:  time.Now().Unix(),
+		Format:   FormatArchive,
+	}
+	if options.Incremental {
+		manifest.Format = FormatSnapshot
+	}
+
+	if async {
+		background := manifest
+		go func() {
+			defer end(server.Id())
+			createBackup(server, options, &background)
+		}()
+		return
+	}
+
+	defer end(server.Id())
+	err = createBackup(server, options, &manifest)
+	return
+}
+
+func createBackup(server programs.Program, options Options, manifest *Manifest) (err error) {
+	env := server.GetEnvironment()
+	env.DisplayToConsole("Creating backup %s\n", manifest.Id)
+
+	defer func() {
+		if err != nil {
+			logging.Error("Error creating backup of server "+server.Id(), err)
+			env.DisplayToConsole("Failed to create backup: %s\n", err.Error())
+		}
+	}()
+
+	running, err := server.IsRunning()
+	if err != nil {
+		return
+	}
+
+	stopped := false
+	if running && options.Stop {
+		_, err = server.StopAndWait()
+		if err != nil {
+			return
+		}
+		stopped = true
+	} else if running && options.SaveCommand != "" {
+		err = server.Execute(options.SaveCommand)
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Duration(config.GetIntOrDefault("backupSaveDelay", 5)) * time.Second)
+	}
+
+	err = writeBackup(env.GetRootDirectory(), manifest)
+
+	if stopped {
+		if sErr := server.Start(); sErr != nil {
+			logging.Error("Error starting server "+server.Id()+" after backup", sErr)
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	env.DisplayToConsole("Backup %s created\n", manifest.Id)
+
+	if rErr := applyRetention(server); rErr != nil {
+		logging.Error("Error removing old backups of server "+server.Id(), rErr)
+	} else if manifest.Format == FormatSnapshot {
+		if _, rErr = pruneChunks(server.Id()); rErr != nil {
+			logging.Error("Error removing unused chunks of server "+server.Id(), rErr)
+		}
+	}
+	return
+}
+
+func writeBackup(root string, manifest *Manifest) (err error) {
+	folder := common.JoinPath(GetFolder(), manifest.Server)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		return
+	}
+
+	target := getBackupFile(*manifest)
+	if manifest.Format == FormatSnapshot {
+		var previous *snapshot
+		if last, ok := latestSnapshot(manifest.Server); ok {
+			if previous, err = loadSnapshot(getBackupFile(last)); err != nil {
+				logging.Error("Error reading previous snapshot, all files will be read", err)
+			}
+		}
+		manifest.Size, err = writeSnapshot(root, getChunkStore(manifest.Server), previous, target)
+	} else {
+		manifest.Size, err = writeBackupArchive(root, manifest, target)
+	}
+	if err != nil {
+		return
+	}
+
+	//the manifest is written last, so only finished backups are listed
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(common.JoinPath(folder, manifest.Id+".json"), data, 0644)
+}
+
+func writeBackupArchive(root string, manifest *Manifest, target string) (size int64, err error) {
+	archiveManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return
+	}
+
+	file, err := os.Create(target + ".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(target + ".tmp")
+
+	err = writeArchive(root, file, archiveManifest)
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(target+".tmp", target)
+	if err != nil {
+		return
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return
+	}
+	return info.Size(), nil
+}
+
+func latestSnapshot(serverId string) (Manifest, bool) {
+	backups, err := List(serverId)
+	if err != nil {
+		return Manifest{}, false
+	}
+	for _, v := range backups {
+		if v.Format == FormatSnapshot {
+			return v, true
+		}
+	}
+	return Manifest{}, false
+}
+
+func getBackupFile(manifest Manifest) string {
+	if manifest.Format == FormatSnapshot {
+		return common.JoinPath(GetFolder(), manifest.Server, manifest.Id+".snapshot")
+	}
+	return common.JoinPath(GetFolder(), manifest.Server, manifest.Id+".tar.gz")
+}
+
+//Lists the backups of a server, newest first
+func List(serverId string) ([]Manifest, error) {
+	result := make([]Manifest, 0)
+
+	files, err := ioutil.ReadDir(common.JoinPath(GetFolder(), serverId))
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		manifest, err := readManifest(serverId, strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			logging.Error("Error reading backup manifest "+file.Name(), err)
+			continue
+		}
+		result = append(result, manifest)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created > result[j].Created
+	})
+	return result, nil
+}
+
+//Gets the manifest of a backup and the path to its archive or snapshot index
+func Get(serverId, id string) (manifest Manifest, file string, err error) {
+	manifest, err = readManifest(serverId, id)
+	if err != nil {
+		return
+	}
+	file = getBackupFile(manifest)
+	return
+}
+
+//Writes the backup as a gzipped tar, building one from the chunks if it is a snapshot
+func Export(serverId, id string, target io.Writer) error {
+	manifest, file, err := Get(serverId, id)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Format != FormatSnapshot {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(target, f)
+		return err
+	}
+
+	snap, err := loadSnapshot(file)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return exportSnapshot(snap, getChunkStore(serverId), data, target)
+}
+
+//Checks the backup can be restored, returning a description of each problem found
+func Verify(serverId, id string) ([]string, error) {
+	manifest, file, err := Get(serverId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Format != FormatSnapshot {
+		//reading the whole archive checks every entry against its checksum
+		f, err := os.Open(file)
+		if err != nil {
+			return []string{err.Error()}, nil
+		}
+		defer f.Close()
+		if _, err = extractArchive(f, "", func(string) bool { return false }); err != nil {
+			return []string{err.Error()}, nil
+		}
+		return []string{}, nil
+	}
+
+	snap, err := loadSnapshot(file)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	return verifySnapshot(snap, getChunkStore(serverId)), nil
+}
+
+//Removes the backup. Chunks of a snapshot are only removed once nothing else uses them, when the server is pruned.
+//Backups cannot be removed while a backup, restore or prune of the server is running, as it may be using them.
+func Delete(serverId, id string) error {
+	err := begin(serverId)
+	if err != nil {
+		return err
+	}
+	defer end(serverId)
+	return deleteBackup(serverId, id)
+}
+
+func deleteBackup(serverId, id string) error {
+	_, archive, err := Get(serverId, id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(archive)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(common.JoinPath(GetFolder(), serverId, id+".json"))
+}
+
+//Replaces the files of the server with those in the backup, stopping the server first if needed.
+//If a file is given, only that file or folder is restored, over the current files and without stopping the server.
+func Restore(server programs.Program, id, file string, async bool) (err error) {
+	manifest, _, err := Get(server.Id(), id)
+	if err != nil {
+		return
+	}
+
+	err = begin(server.Id())
+	if err != nil {
+		return
+	}
+
+	restore := func() error {
+		defer end(server.Id())
+		if file != "" {
+			return restoreFile(server, manifest, file)
+		}
+		return restoreBackup(server, manifest)
+	}
+
+	if async {
+		go restore()
+		return
+	}
+	return restore()
+}
+
+func restoreBackup(server programs.Program, manifest Manifest) (err error) {
+	env := server.GetEnvironment()
+	env.DisplayToConsole("Restoring backup %s\n", manifest.Id)
+
+	defer func() {
+		if err != nil {
+			logging.Error("Error restoring backup of server "+server.Id(), err)
+			env.DisplayToConsole("Failed to restore backup: %s\n", err.Error())
+		}
+	}()
+
+	running, err := server.IsRunning()
+	if err != nil {
+		return
+	}
+	if running {
+		_, err = server.StopAndWait()
+		if err != nil {
+			return
+		}
+	}
+
+	//extracted next to the server first, so a broken backup leaves the current files alone
+	root := filepath.Clean(env.GetRootDirectory())
+	temp := root + ".restore"
+	os.RemoveAll(temp)
+	err = os.MkdirAll(temp, 0755)
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(temp)
+
+	_, err = extractBackup(manifest, temp, nil)
+	if err != nil {
+		return
+	}
+
+	old := root + ".old"
+	os.RemoveAll(old)
+	err = os.Rename(root, old)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = os.Rename(temp, root)
+	if err != nil {
+		os.Rename(old, root)
+		return
+	}
+	os.RemoveAll(old)
+
+	err = env.ResetOwnership()
+	if err != nil {
+		return
+	}
+
+	env.DisplayToConsole("Backup %s restored\n", manifest.Id)
+	return
+}
+
+func restoreFile(server programs.Program, manifest Manifest, file string) (err error) {
+	env := server.GetEnvironment()
+	name := path.Clean(strings.TrimPrefix(filepath.ToSlash(file), "/"))
+	env.DisplayToConsole("Restoring %s from backup %s\n", name, manifest.Id)
+
+	defer func() {
+		if err != nil {
+			logging.Error("Error restoring file from backup of server "+server.Id(), err)
+			env.DisplayToConsole("Failed to restore %s: %s\n", name, err.Error())
+		}
+	}()
+
+	count, err := extractBackup(manifest, env.GetRootDirectory(), func(entry string) bool {
+		return entry == name || strings.HasPrefix(entry, name+"/")
+	})
+	if err != nil {
+		return
+	}
+	if count == 0 {
+		return ErrNoFile
+	}
+
+	err = env.ResetOwnership()
+	if err != nil {
+		return
+	}
+
+	env.DisplayToConsole("Restored %s from backup %s\n", name, manifest.Id)
+	return
+}
+
+func extractBackup(manifest Manifest, target string, filter func(name string) bool) (int, error) {
+	if manifest.Format == FormatSnapshot {
+		snap, err := loadSnapshot(getBackupFile(manifest))
+		if err != nil {
+			return 0, err
+		}
+		return extractSnapshot(snap, getChunkStore(manifest.Server), target, filter)
+	}
+
+	file, err := os.Open(getBackupFile(manifest))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return extractArchive(file, target, filter)
+}
+
+//Applies the retention settings of the server, then removes chunks no snapshot uses any more
+func Prune(server programs.Program) (freed int64, err error) {
+	err = begin(server.Id())
+	if err != nil {
+		return
+	}
+	defer end(server.Id())
+
+	err = applyRetention(server)
+	if err != nil {
+		return
+	}
+	return pruneChunks(server.Id())
+}
+
+func pruneChunks(serverId string) (int64, error) {
+	backups, err := List(serverId)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshots := make([]*snapshot, 0)
+	for _, v := range backups {
+		if v.Format != FormatSnapshot {
+			continue
+		}
+		snap, err := loadSnapshot(getBackupFile(v))
+		if err != nil {
+			//without knowing what it uses, removing anything could break it
+			return 0, fmt.Errorf("cannot read snapshot %s: %s", v.Id, err.Error())
+		}
+		snapshots = append(snapshots, snap)
+	}
+
+	return collectGarbage(getChunkStore(serverId), snapshots)
+}
+
+//Removes backups of the server which fall outside of its retention settings.
+//The newest backup is always kept. The server must already be marked as busy.
+func applyRetention(server programs.Program) error {
+	settings := server.GetBackupSettings()
+	if settings.Keep <= 0 && settings.MaxAgeDays <= 0 && settings.MaxSize <= 0 {
+		return nil
+	}
+
+	backups, err := List(server.Id())
+	if err != nil {
+		return err
+	}
+
+	oldest := time.Now().AddDate(0, 0, -settings.MaxAgeDays).Unix()
+	var total int64
+	for i, v := range backups {
+		total += v.Size
+		if i == 0 {
+			continue
+		}
+
+		remove := (settings.Keep > 0 && i >= settings.Keep) ||
+			(settings.MaxAgeDays > 0 && v.Created < oldest) ||
+			(settings.MaxSize > 0 && total > settings.MaxSize)
+		if !remove {
+			continue
+		}
+
+		logging.Debugf("Removing backup %s of server %s", v.Id, server.Id())
+		if err = deleteBackup(server.Id(), v.Id); err != nil {
+			return err
+		}
+		total -= v.Size
+	}
+	return nil
+}
+
+func readManifest(serverId, id string) (manifest Manifest, err error) {
+	//ids are used as file names, so they cannot be allowed to point elsewhere
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		err = ErrNoBackup
+		return
+	}
+
+	data, err := ioutil.ReadFile(common.JoinPath(GetFolder(), serverId, id+".json"))
+	if os.IsNotExist(err) {
+		err = ErrNoBackup
+		return
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &manifest)
+	return
+}
+
+func begin(serverId string) error {
+	busyLocker.Lock()
+	defer busyLocker.Unlock()
+	if busy[serverId] {
+		return ErrBackupRunning
+	}
+	busy[serverId] = true
+	return nil
+}
+
+func end(serverId string) {
+	busyLocker.Lock()
+	defer busyLocker.Unlock()
+	delete(busy, serverId)
+}
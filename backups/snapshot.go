@@ -0,0 +1,402 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package backups
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pufferpanel/pufferd/commons"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//Files are split into chunks of this size, so a change only stores the chunks it touched.
+//Fixed offsets suit game saves, which rewrite parts of files in place rather than inserting data.
+const chunkSize = 1024 * 1024
+
+//A file, folder or symlink in a snapshot
+type snapshotEntry struct {
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime int64       `json:"modTime"`
+	Size    int64       `json:"size,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	Chunks  []string    `json:"chunks,omitempty"`
+}
+
+type snapshot struct {
+	Entries []snapshotEntry `json:"entries"`
+}
+
+//Content-addressed store of compressed chunks, named by the sha256 of their uncompressed data
+type chunkStore struct {
+	folder string
+}
+
+func (c chunkStore) path(hash string) string {
+	return filepath.Join(c.folder, hash[:2], hash)
+}
+
+func (c chunkStore) has(hash string) bool {
+	_, err := os.Stat(c.path(hash))
+	return err == nil
+}
+
+//Stores the chunk unless it is already present, returning how many bytes were added to the store
+func (c chunkStore) put(data []byte) (hash string, stored int64, err error) {
+	sum := sha256.Sum256(data)
+	hash = hex.EncodeToString(sum[:])
+	if c.has(hash) {
+		return
+	}
+
+	file := c.path(hash)
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return
+	}
+
+	buffer := &bytes.Buffer{}
+	gz := gzip.NewWriter(buffer)
+	if _, err = gz.Write(data); err != nil {
+		return
+	}
+	if err = gz.Close(); err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(file+".tmp", buffer.Bytes(), 0644)
+	if err != nil {
+		return
+	}
+	err = os.Rename(file+".tmp", file)
+	stored = int64(buffer.Len())
+	return
+}
+
+//Reads a chunk, checking it still matches its hash
+func (c chunkStore) get(hash string) ([]byte, error) {
+	file, err := os.Open(c.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("chunk %s is corrupt", hash)
+	}
+	return data, nil
+}
+
+func getChunkStore(serverId string) chunkStore {
+	return chunkStore{folder: filepath.Join(GetFolder(), serverId, "chunks")}
+}
+
+//Stores the files of the root folder as a snapshot.
+//Files with the same size and modification time as in the previous snapshot are not read again.
+func writeSnapshot(root string, store chunkStore, previous *snapshot, target string) (stored int64, err error) {
+	unchanged := make(map[string]snapshotEntry)
+	if previous != nil {
+		for _, v := range previous.Entries {
+			unchanged[v.Path] = v
+		}
+	}
+
+	result := &snapshot{Entries: make([]snapshotEntry, 0)}
+	buffer := make([]byte, chunkSize)
+
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, file)
+		if err != nil || name == "." {
+			return err
+		}
+
+		entry := snapshotEntry{
+			Path:    filepath.ToSlash(name),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime().UnixNano(),
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		case info.IsDir():
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			if old, ok := unchanged[entry.Path]; ok && old.Size == entry.Size && old.ModTime == entry.ModTime && old.Mode == entry.Mode && hasChunks(store, old.Chunks) {
+				entry.Chunks = old.Chunks
+				break
+			}
+
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			for {
+				n, err := io.ReadFull(f, buffer)
+				if n > 0 {
+					hash, added, pErr := store.put(buffer[:n])
+					if pErr != nil {
+						return pErr
+					}
+					entry.Chunks = append(entry.Chunks, hash)
+					stored += added
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				} else if err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+
+		result.Entries = append(result.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = saveSnapshot(result, target)
+	return
+}
+
+func hasChunks(store chunkStore, chunks []string) bool {
+	for _, v := range chunks {
+		if !store.has(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func saveSnapshot(snap *snapshot, target string) (err error) {
+	file, err := os.Create(target + ".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(target + ".tmp")
+
+	gz := gzip.NewWriter(file)
+	err = json.NewEncoder(gz).Encode(snap)
+	if cErr := gz.Close(); err == nil {
+		err = cErr
+	}
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(target+".tmp", target)
+}
+
+func loadSnapshot(source string) (*snapshot, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	result := &snapshot{}
+	err = json.NewDecoder(gz).Decode(result)
+	return result, err
+}
+
+//Writes the entries of the snapshot accepted by the filter into the target folder
+func extractSnapshot(snap *snapshot, store chunkStore, target string, filter func(name string) bool) (count int, err error) {
+	for _, entry := range snap.Entries {
+		name := commons.CleanArchiveName(entry.Path, 0)
+		if name == "" || (filter != nil && !filter(name)) {
+			continue
+		}
+		item := commons.ArchiveEntry{Name: name, Mode: entry.Mode, Link: entry.Link, ModTime: time.Unix(0, entry.ModTime)}
+		var data io.Reader
+		if entry.Mode.IsRegular() {
+			data = &chunkReader{store: store, chunks: entry.Chunks}
+		}
+		if err = commons.WriteArchiveEntry(target, item, data); err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
+
+//Writes the snapshot as a gzipped tar, in the same layout as a full backup
+func exportSnapshot(snap *snapshot, store chunkStore, manifest []byte, target io.Writer) (err error) {
+	gz := gzip.NewWriter(target)
+	defer func() {
+		if cErr := gz.Close(); err == nil {
+			err = cErr
+		}
+	}()
+	tw := tar.NewWriter(gz)
+	defer func() {
+		if cErr := tw.Close(); err == nil {
+			err = cErr
+		}
+	}()
+
+	err = tw.WriteHeader(&tar.Header{Name: manifestEntry, Mode: 0644, Size: int64(len(manifest)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return
+	}
+	if _, err = tw.Write(manifest); err != nil {
+		return
+	}
+
+	for _, entry := range snap.Entries {
+		header := &tar.Header{
+			Name:    entry.Path,
+			Mode:    int64(entry.Mode.Perm()),
+			ModTime: time.Unix(0, entry.ModTime),
+		}
+		switch {
+		case entry.Mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.Link
+		case entry.Mode.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = entry.Size
+		}
+
+		if err = tw.WriteHeader(header); err != nil {
+			return
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err = io.CopyN(tw, &chunkReader{store: store, chunks: entry.Chunks}, entry.Size); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+//Reads a file back from its chunks
+type chunkReader struct {
+	store   chunkStore
+	chunks  []string
+	current []byte
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		r.current, err = r.store.get(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunks = r.chunks[1:]
+	}
+	n = copy(p, r.current)
+	r.current = r.current[n:]
+	return
+}
+
+//Checks every chunk of the snapshot is present and undamaged, returning a description of each problem
+func verifySnapshot(snap *snapshot, store chunkStore) []string {
+	problems := make([]string, 0)
+	checked := make(map[string]bool)
+	for _, entry := range snap.Entries {
+		for _, hash := range entry.Chunks {
+			valid, ok := checked[hash]
+			if !ok {
+				_, err := store.get(hash)
+				valid = err == nil
+				checked[hash] = valid
+				if !valid {
+					problems = append(problems, fmt.Sprintf("chunk %s: %s", hash, err.Error()))
+				}
+			}
+			if !valid {
+				problems = append(problems, "file "+entry.Path+" cannot be restored")
+				break
+			}
+		}
+	}
+	return problems
+}
+
+//Removes chunks no snapshot refers to any more, returning how many bytes were freed
+func collectGarbage(store chunkStore, snapshots []*snapshot) (freed int64, err error) {
+	used := make(map[string]bool)
+	for _, snap := range snapshots {
+		for _, entry := range snap.Entries {
+			for _, hash := range entry.Chunks {
+				used[hash] = true
+			}
+		}
+	}
+
+	err = filepath.Walk(store.folder, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if used[info.Name()] {
+			return nil
+		}
+		if err = os.Remove(file); err != nil {
+			return err
+		}
+		freed += info.Size()
+		return nil
+	})
+	return
+}
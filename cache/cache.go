@@ -22,12 +22,17 @@ import (
 )
 
 func CreateCache() *cache.MemoryCache {
+	return &cache.MemoryCache{
+		Buffer:   make([]cache.Message, 0),
+		Capacity: GetConsoleBufferSize(),
+	}
+}
+
+//Gets how many lines of console output are kept in memory
+func GetConsoleBufferSize() int {
 	capacity := config.GetIntOrDefault("console-buffer", 0)
 	if capacity == 0 {
 		capacity = config.GetIntOrDefault("consoleBuffer", 50)
 	}
-	return &cache.MemoryCache{
-		Buffer:   make([]cache.Message, 0),
-		Capacity: capacity,
-	}
+	return capacity
 }
@@ -0,0 +1,217 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package commons
+
+import (
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ArchiveZip   = "zip"
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+	ArchiveTarXz = "tar.xz"
+)
+
+//Gets the archive format from the extension of the file, or an empty string if it is not a known archive
+func GetArchiveFormat(file string) string {
+	name := strings.ToLower(file)
+	switch {
+	case strings.HasSuffix(name, ".zip"), strings.HasSuffix(name, ".jar"):
+		return ArchiveZip
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz
+	case strings.HasSuffix(name, ".tar.xz"), strings.HasSuffix(name, ".txz"):
+		return ArchiveTarXz
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar
+	}
+	return ""
+}
+
+//Resolves a path relative to the root folder, refusing any which end up outside of it,
+//including through symlinks which already exist.
+func ResolvePath(root, file string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	target := common.JoinPath(root, file)
+	if !common.EnsureAccess(target, root) || !isWithin(root, target) {
+		return "", fmt.Errorf("%s is outside of the server folder", file)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	//the deepest part which exists decides where the rest will be written
+	existing := target
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !isWithin(realRoot, resolved) {
+				return "", fmt.Errorf("%s is outside of the server folder", file)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	return target, nil
+}
+
+//A file, folder or symlink read from an archive
+type ArchiveEntry struct {
+	//Path relative to the folder the entry is written to, using slashes
+	Name string
+	Mode os.FileMode
+	//Where a symlink points to
+	Link    string
+	ModTime time.Time
+}
+
+//Writes the entry into the root folder, replacing whatever is there rather than writing through it.
+//Entries are refused if they would end up outside of the folder, by their name, through a symlink already in it,
+//or by being a symlink which points outside of it.
+func WriteArchiveEntry(root string, entry ArchiveEntry, data io.Reader) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	file, err := ResolvePath(root, filepath.FromSlash(entry.Name))
+	if err != nil {
+		return err
+	}
+
+	if entry.Mode.IsDir() {
+		err = os.MkdirAll(file, entry.Mode.Perm()|0700)
+	} else {
+		err = writeArchiveFile(root, file, entry, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	if entry.Mode&os.ModeSymlink == 0 && !entry.ModTime.IsZero() {
+		os.Chtimes(file, entry.ModTime, entry.ModTime)
+	}
+	return nil
+}
+
+func writeArchiveFile(root, file string, entry ArchiveEntry, data io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if entry.Mode&os.ModeSymlink != 0 {
+		link := entry.Link
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(file), link)
+		}
+		relative, err := filepath.Rel(root, link)
+		if err == nil {
+			_, err = ResolvePath(root, relative)
+		}
+		if err != nil {
+			return fmt.Errorf("symlink %s points outside of the server folder", entry.Name)
+		}
+		return os.Symlink(entry.Link, file)
+	}
+
+	mode := entry.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, data)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+//Cleans the name of an archive entry and removes its first strip folders.
+//Names are always relative, so .. cannot climb out of the folder the archive is extracted to.
+//An empty name means nothing is left after stripping.
+func CleanArchiveName(name string, strip int) string {
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))[1:]
+	if name == "" {
+		return ""
+	}
+
+	parts := strings.Split(name, "/")
+	if strip >= len(parts) {
+		return ""
+	}
+	return strings.Join(parts[strip:], "/")
+}
+
+//Checks the name against the include and exclude globs, where no includes means everything is included.
+//Globs with a slash match the full name or a folder it is in, others match any part of the name, so *.jar matches a/b.jar.
+func MatchArchiveName(name string, include, exclude []string) bool {
+	if matchesAny(name, exclude) {
+		return false
+	}
+	return len(include) == 0 || matchesAny(name, include)
+}
+
+func matchesAny(name string, globs []string) bool {
+	for _, glob := range globs {
+		glob = strings.TrimSuffix(strings.TrimPrefix(glob, "/"), "/")
+		if !strings.Contains(glob, "/") {
+			for _, part := range strings.Split(name, "/") {
+				if matched, _ := path.Match(glob, part); matched {
+					return true
+				}
+			}
+			continue
+		}
+		for current := name; current != "." && current != ""; current = path.Dir(current) {
+			if matched, _ := path.Match(glob, current); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWithin(root, target string) bool {
+	return target == root || strings.HasPrefix(target, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
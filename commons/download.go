@@ -17,32 +17,308 @@
 package commons
 
 import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/config"
 	"github.com/pufferpanel/apufferi/logging"
 	"github.com/pufferpanel/pufferd/environments"
+	"hash"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-func DownloadFile(url, fileName string, env environments.Environment) error {
-	target, err := os.Create(path.Join(env.GetRootDirectory(), fileName))
+//Locks for each file in the download cache, so servers installing at the same time download a file once.
+//Entries are removed once no one holds or waits for them.
+var cacheLocks = make(map[string]*cacheLock)
+var cacheLocksLocker sync.Mutex
+
+type cacheLock struct {
+	sync.Mutex
+	users int
+}
+
+//Client for downloads, which gives up on servers which do not answer rather than waiting forever.
+//The download as a whole is limited by the downloadTimeout setting.
+var downloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+//Expected hash of a download, which is not checked if no value is given
+type Checksum struct {
+	//sha1 or sha256
+	Type  string
+	Value string
+}
+
+func (c Checksum) newHash() (hash.Hash, error) {
+	switch strings.ToLower(c.Type) {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unknown checksum type %s", c.Type)
+}
+
+//Downloads the file into the server folder, using the name from the url if no file name is given.
+//Downloads with a checksum are verified, and kept in the download cache so the same file is only fetched once per node.
+func DownloadFile(url, fileName string, checksum Checksum, env environments.Environment) error {
+	if fileName == "" {
+		fileName = getFileName(url)
+	}
+
+	root, err := filepath.Abs(env.GetRootDirectory())
+	if err != nil {
+		return err
+	}
+	target, err := ResolvePath(root, fileName)
+	if err != nil {
+		return err
+	}
+
+	if checksum.Type == "" || checksum.Value == "" {
+		return fetch(url, target, checksum, env)
+	}
+
+	if _, err = checksum.newHash(); err != nil {
+		return err
+	}
+
+	cached := getCacheFile(url, checksum)
+	unlock := lockCacheFile(cached)
+	defer unlock()
+
+	if err = verifyFile(cached, checksum); err == nil {
+		logging.Debugf("Using cached download of %s", url)
+		env.DisplayToConsole("Using cached download of %s\n", url)
+		return copyFile(cached, target)
+	} else if !os.IsNotExist(err) {
+		logging.Error("Cached download of "+url+" is invalid, downloading again", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(cached), 0755)
 	if err != nil {
 		return err
 	}
-	defer target.Close()
+	err = fetch(url, cached, checksum, env)
+	if err != nil {
+		return err
+	}
+	return copyFile(cached, target)
+}
 
-	client := &http.Client{}
+func GetDownloadCacheFolder() string {
+	return config.GetStringOrDefault("downloadCacheFolder", common.JoinPath(config.GetStringOrDefault("dataFolder", "data"), "cache"))
+}
 
+func lockCacheFile(file string) func() {
+	cacheLocksLocker.Lock()
+	lock, ok := cacheLocks[file]
+	if !ok {
+		lock = &cacheLock{}
+		cacheLocks[file] = lock
+	}
+	lock.users++
+	cacheLocksLocker.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		cacheLocksLocker.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(cacheLocks, file)
+		}
+		cacheLocksLocker.Unlock()
+	}
+}
+
+//Downloads into a temporary file next to the target, so a failed or mismatched download never replaces the target.
+//Each download has its own temporary file, and the checksum is of the file as written.
+func fetch(url, target string, checksum Checksum, env environments.Environment) error {
 	logging.Debug("Downloading: " + url)
 	env.DisplayToConsole("Downloading: " + url + "\n")
 
-	response, err := client.Get(url)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.GetIntOrDefault("downloadTimeout", 3600))*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
+
+	//a cancelled job stops the download, even while waiting on the remote server
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+				if job := env.GetJob(); job != nil && job.Cancelled() {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	response, err := downloadClient.Do(request.WithContext(ctx))
+	if err != nil {
+		if job := env.GetJob(); job != nil && job.Cancelled() {
+			return environments.ErrCancelled
+		}
+		return err
+	}
 	defer response.Body.Close()
 
-	_, err = io.Copy(target, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s failed: %s", url, response.Status)
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	var body io.Reader = response.Body
+	if job := env.GetJob(); job != nil {
+		body = &progressReader{reader: response.Body, job: job, total: response.ContentLength}
+	}
+
+	//temporary files are only readable by the daemon, but the server may run as another user
+	err = file.Chmod(0644)
+	if err == nil {
+		_, err = io.Copy(file, body)
+	}
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		if job := env.GetJob(); job != nil && job.Cancelled() {
+			return environments.ErrCancelled
+		}
+		return err
+	}
+
+	if checksum.Type != "" && checksum.Value != "" {
+		if err = verifyFile(file.Name(), checksum); err != nil {
+			env.DisplayToConsole("Checksum of %s does not match\n", url)
+			return fmt.Errorf("checksum of %s: %s", url, err.Error())
+		}
+	}
+
+	return os.Rename(file.Name(), target)
+}
+
+func verifyFile(file string, checksum Checksum) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher, err := checksum.newHash()
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(hasher, f); err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(actual, checksum.Value) {
+		return fmt.Errorf("%s checksum is %s, expected %s", checksum.Type, actual, checksum.Value)
+	}
+	return nil
+}
+
+//Cached files are keyed by the url and checksum, so a changed file behind the same url is never served from the cache
+func getCacheFile(url string, checksum Checksum) string {
+	key := sha256.Sum256([]byte(url + "\n" + strings.ToLower(checksum.Type) + ":" + strings.ToLower(checksum.Value)))
+	name := hex.EncodeToString(key[:])
+	return common.JoinPath(GetDownloadCacheFolder(), name[:2], name)
+}
+
+func getFileName(source string) string {
+	if parsed, err := url.Parse(source); err == nil && parsed.Path != "" {
+		source = parsed.Path
+	}
+	name := path.Base(source)
+	if name == "." || name == "/" {
+		return "download"
+	}
+	return name
+}
+
+func copyFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
 	return err
 }
+
+//Reports the progress of a download to the job, stopping it if the job is cancelled
+type progressReader struct {
+	reader io.Reader
+	job    environments.Job
+	done   int64
+	total  int64
+}
+
+func (r *progressReader) Read(p []byte) (n int, err error) {
+	if r.job.Cancelled() {
+		return 0, environments.ErrCancelled
+	}
+	n, err = r.reader.Read(p)
+	r.done += int64(n)
+	r.job.DownloadProgress(r.done, r.total)
+	return
+}
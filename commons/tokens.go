@@ -0,0 +1,177 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package commons
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Filters which can be applied to a token, such as ${name|upper}
+var tokenFilters = map[string]func(string) string{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"quote": strconv.Quote,
+}
+
+//Replaces the tokens in the message with their values from the data.
+//Tokens take the form ${name}, ${name:-default} or ${name|filter}, where filters can be chained and are applied after the default.
+//A default may contain |, only the filter names at its end are taken as filters.
+//$${ is written as a literal ${. Tokens with no value and no default are an error.
+func ReplaceTokens(msg string, data map[string]interface{}) (string, error) {
+	if !strings.Contains(msg, "${") {
+		return msg, nil
+	}
+
+	result := bytes.Buffer{}
+	for {
+		start := strings.Index(msg, "${")
+		if start == -1 {
+			result.WriteString(msg)
+			return result.String(), nil
+		}
+
+		if start > 0 && msg[start-1] == '$' {
+			result.WriteString(msg[:start-1])
+			result.WriteString("${")
+			msg = msg[start+2:]
+			continue
+		}
+
+		end := strings.Index(msg[start:], "}")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated token in %s", msg)
+		}
+		end += start
+
+		value, err := replaceToken(msg[start+2:end], data)
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(msg[:start])
+		result.WriteString(value)
+		msg = msg[end+1:]
+	}
+}
+
+func replaceToken(token string, data map[string]interface{}) (string, error) {
+	name, def, hasDefault := token, "", false
+	var filters []string
+	if i := strings.Index(token, ":-"); i != -1 {
+		name, def, hasDefault = token[:i], token[i+2:], true
+		for {
+			i = strings.LastIndex(def, "|")
+			if i == -1 {
+				break
+			}
+			if _, ok := tokenFilters[strings.TrimSpace(def[i+1:])]; !ok {
+				break
+			}
+			filters = append([]string{def[i+1:]}, filters...)
+			def = def[:i]
+		}
+		if strings.Contains(name, "|") {
+			return "", fmt.Errorf("filters in ${%s} have to come after the default", token)
+		}
+	} else {
+		parts := strings.Split(token, "|")
+		name, filters = parts[0], parts[1:]
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("token ${%s} has no variable name", token)
+	}
+
+	var value string
+	if v, ok := data[name]; ok && v != nil && fmt.Sprint(v) != "" {
+		value = fmt.Sprint(v)
+	} else if hasDefault {
+		value = def
+	} else if ok {
+		value = ""
+	} else {
+		return "", fmt.Errorf("undefined variable %s", name)
+	}
+
+	for _, filter := range filters {
+		apply, ok := tokenFilters[strings.TrimSpace(filter)]
+		if !ok {
+			return "", fmt.Errorf("unknown filter %s in ${%s}", strings.TrimSpace(filter), token)
+		}
+		value = apply(value)
+	}
+	return value, nil
+}
+
+func ReplaceTokensInArr(msg []string, data map[string]interface{}) ([]string, error) {
+	result := make([]string, len(msg))
+	for i, v := range msg {
+		value, err := ReplaceTokens(v, data)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = value
+	}
+	return result, nil
+}
+
+func ReplaceTokensInMap(msg map[string]string, data map[string]interface{}) (map[string]string, error) {
+	result := make(map[string]string, len(msg))
+	for k, v := range msg {
+		value, err := ReplaceTokens(v, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err.Error())
+		}
+		result[k] = value
+	}
+	return result, nil
+}
+
+//Replaces tokens in every string in the value, going through nested maps and slices such as those decoded from json
+func ReplaceTokensInValue(value interface{}, data map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return ReplaceTokens(v, data)
+	case []string:
+		return ReplaceTokensInArr(v, data)
+	case map[string]string:
+		return ReplaceTokensInMap(v, data)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			replaced, err := ReplaceTokensInValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = replaced
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			replaced, err := ReplaceTokensInValue(item, data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err.Error())
+			}
+			result[k] = replaced
+		}
+		return result, nil
+	}
+	return value, nil
+}
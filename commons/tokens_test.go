@@ -0,0 +1,119 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package commons
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplaceTokens(t *testing.T) {
+	data := map[string]interface{}{
+		"name":  "Server",
+		"port":  25565,
+		"empty": "",
+		"null":  nil,
+	}
+
+	tests := []struct {
+		name    string
+		msg     string
+		want    string
+		wantErr bool
+	}{
+		{name: "no tokens", msg: "java -jar server.jar", want: "java -jar server.jar"},
+		{name: "value", msg: "${name}", want: "Server"},
+		{name: "number", msg: "--port=${port}", want: "--port=25565"},
+		{name: "several", msg: "${name}:${port}", want: "Server:25565"},
+		{name: "spaces around name", msg: "${ name }", want: "Server"},
+
+		{name: "default not used", msg: "${name:-other}", want: "Server"},
+		{name: "default for missing", msg: "${missing:-other}", want: "other"},
+		{name: "default for empty", msg: "${empty:-other}", want: "other"},
+		{name: "default for nil", msg: "${null:-other}", want: "other"},
+		{name: "empty default", msg: "a${missing:-}b", want: "ab"},
+		{name: "default with colon", msg: "${missing:-a:-b}", want: "a:-b"},
+
+		{name: "upper", msg: "${name|upper}", want: "SERVER"},
+		{name: "lower", msg: "${name|lower}", want: "server"},
+		{name: "quote", msg: "${name|quote}", want: `"Server"`},
+		{name: "chained filters", msg: "${name|lower|quote}", want: `"server"`},
+		{name: "filter with spaces", msg: "${name | upper}", want: "SERVER"},
+		{name: "filter on default", msg: "${missing:-other|upper}", want: "OTHER"},
+		{name: "filter on empty value", msg: "${empty|upper}", want: ""},
+		{name: "unknown filter", msg: "${name|reverse}", wantErr: true},
+		{name: "filter before default", msg: "${name|upper:-other}", wantErr: true},
+
+		{name: "pipe in default", msg: "${missing:-a|b}", want: "a|b"},
+		{name: "pipe in default with filter", msg: "${missing:-a|b|upper}", want: "A|B"},
+		{name: "pipe at end of default", msg: "${missing:-a|}", want: "a|"},
+		{name: "pipe in unused default", msg: "${name:-a|b}", want: "Server"},
+
+		{name: "escaped", msg: "$${name}", want: "${name}"},
+		{name: "escaped next to token", msg: "$${name}${name}", want: "${name}Server"},
+		{name: "dollar without brace", msg: "$name costs $5", want: "$name costs $5"},
+
+		{name: "undefined", msg: "${missing}", wantErr: true},
+		{name: "empty value", msg: "a${empty}b", want: "ab"},
+		{name: "nil value", msg: "a${null}b", want: "ab"},
+		{name: "no name", msg: "${}", wantErr: true},
+		{name: "no name with default", msg: "${:-x}", wantErr: true},
+		{name: "unterminated", msg: "${name", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReplaceTokens(tt.msg, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReplaceTokens(%q) error = %v, wantErr %v", tt.msg, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReplaceTokens(%q) = %q, want %q", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceTokensInValue(t *testing.T) {
+	data := map[string]interface{}{"name": "Server"}
+
+	value := map[string]interface{}{
+		"text":   "${name}",
+		"number": 5,
+		"list":   []interface{}{"${name|upper}", true},
+		"nested": map[string]interface{}{"inner": "${missing:-x}"},
+	}
+	want := map[string]interface{}{
+		"text":   "Server",
+		"number": 5,
+		"list":   []interface{}{"SERVER", true},
+		"nested": map[string]interface{}{"inner": "x"},
+	}
+
+	got, err := ReplaceTokensInValue(value, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReplaceTokensInValue() = %v, want %v", got, want)
+	}
+
+	_, err = ReplaceTokensInValue(map[string]interface{}{"key": []interface{}{"${missing}"}}, data)
+	if err == nil {
+		t.Error("ReplaceTokensInValue() with an undefined variable did not fail")
+	}
+}
@@ -0,0 +1,325 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package consolelog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/config"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/messages"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	currentFile   = "console.log"
+	rotatedPrefix = "console-"
+	rotatedLayout = "2006-01-02T15-04-05.000"
+	dayLayout     = "2006-01-02"
+
+	//longest line which can be read back
+	maxLine = 1024 * 1024
+)
+
+var ErrDisabled = errors.New("console logs are disabled")
+
+//The console output of a server, kept in files which are rotated by size and by day.
+//Rotated files are gzipped, and only the newest consoleLogFiles of them are kept.
+type Log struct {
+	folder   string
+	file     *os.File
+	size     int64
+	day      string
+	sequence int64
+	failed   bool
+	locker   sync.Mutex
+}
+
+var logs = make(map[string]*Log)
+var logsLocker sync.Mutex
+
+func GetFolder(serverFolder, id string) string {
+	return common.JoinPath(serverFolder, ".logs", id)
+}
+
+//Gets the console log of a server, which is shared by every environment created for it.
+//This is nil if console logs are disabled.
+func Get(serverFolder, id string) *Log {
+	if !config.GetBoolOrDefault("consoleLogs", true) {
+		return nil
+	}
+
+	folder := GetFolder(serverFolder, id)
+	logsLocker.Lock()
+	defer logsLocker.Unlock()
+	if l, ok := logs[folder]; ok {
+		return l
+	}
+
+	l := &Log{folder: folder}
+	l.recover()
+	logs[folder] = l
+	return l
+}
+
+//Closes the console log of a server and removes its files
+func Delete(serverFolder, id string) error {
+	folder := GetFolder(serverFolder, id)
+	logsLocker.Lock()
+	if l, ok := logs[folder]; ok {
+		l.locker.Lock()
+		l.close()
+		l.locker.Unlock()
+		delete(logs, folder)
+	}
+	logsLocker.Unlock()
+	return os.RemoveAll(folder)
+}
+
+//Writes the line to the log. Errors are logged rather than returned, so they do not stop the console being shown.
+func (l *Log) WriteLine(line messages.ConsoleLine) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	now := time.Unix(0, line.Time*int64(time.Millisecond))
+	if l.file != nil && (l.size >= getMaxSize() || l.day != now.Format(dayLayout)) {
+		l.rotate(now)
+	}
+
+	err := l.open(now)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(line)
+		if err == nil {
+			var n int
+			n, err = l.file.Write(append(data, '\n'))
+			l.size += int64(n)
+		}
+	}
+
+	//a full disk would otherwise log every line
+	if err != nil {
+		if !l.failed {
+			logging.Error("Error writing console log", err)
+		}
+		l.failed = true
+		return
+	}
+	l.failed = false
+	l.sequence = line.Sequence
+}
+
+//Gets the sequence of the last line in the log, which new lines carry on from
+func (l *Log) LastSequence() int64 {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	return l.sequence
+}
+
+func (l *Log) open(now time.Time) error {
+	if l.file != nil {
+		return nil
+	}
+
+	err := os.MkdirAll(l.folder, 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(common.JoinPath(l.folder, currentFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	l.day = now.Format(dayLayout)
+	if l.size > 0 {
+		l.day = info.ModTime().Format(dayLayout)
+	}
+	return nil
+}
+
+func (l *Log) close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+//Moves the current file aside and gzips it in the background
+func (l *Log) rotate(now time.Time) {
+	l.close()
+
+	rotated := common.JoinPath(l.folder, rotatedPrefix+now.UTC().Format(rotatedLayout)+".log")
+	err := os.Rename(common.JoinPath(l.folder, currentFile), rotated)
+	if err != nil {
+		logging.Error("Error rotating console log", err)
+		return
+	}
+	go l.compress(rotated)
+}
+
+func (l *Log) compress(file string) {
+	err := gzipFile(file)
+	if err != nil {
+		logging.Error("Error compressing console log", err)
+		return
+	}
+	l.prune()
+}
+
+func gzipFile(file string) (err error) {
+	source, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+
+	temp := file + ".gz.tmp"
+	target, err := os.Create(temp)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(temp)
+		}
+	}()
+
+	gz := gzip.NewWriter(target)
+	_, err = io.Copy(gz, source)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cErr := target.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return
+	}
+
+	//the plain file is read instead of the gzipped one until it is removed
+	err = os.Rename(temp, file+".gz")
+	if err != nil {
+		return
+	}
+	source.Close()
+	return os.Remove(file)
+}
+
+//Removes the oldest rotated files over the limit
+func (l *Log) prune() {
+	max := config.GetIntOrDefault("consoleLogFiles", 14)
+	files, err := l.files()
+	if err != nil {
+		logging.Error("Error reading console logs", err)
+		return
+	}
+
+	kept := 0
+	for _, file := range files {
+		if file.rotated.IsZero() {
+			continue
+		}
+		kept++
+		if kept <= max {
+			continue
+		}
+		name := strings.TrimSuffix(file.path, ".gz")
+		for _, v := range []string{name, name + ".gz"} {
+			if err := os.Remove(v); err != nil && !os.IsNotExist(err) {
+				logging.Error("Error removing console log", err)
+			}
+		}
+	}
+}
+
+//Picks up from the files a previous run of the daemon left, so sequences carry on and rotations it could not finish are done
+func (l *Log) recover() {
+	files, err := l.files()
+	if err != nil {
+		logging.Error("Error reading console logs", err)
+		return
+	}
+
+	for _, file := range files {
+		if !file.rotated.IsZero() && !strings.HasSuffix(file.path, ".gz") {
+			go l.compress(file.path)
+		}
+	}
+
+	for _, file := range files {
+		found := false
+		err := readLines(file.path, func(line messages.ConsoleLine) bool {
+			l.sequence, found = line.Sequence, true
+			return true
+		})
+		if err != nil {
+			logging.Error("Error reading console log", err)
+			return
+		}
+		if found {
+			return
+		}
+	}
+}
+
+func getMaxSize() int64 {
+	return int64(config.GetIntOrDefault("consoleLogSize", 10)) * 1024 * 1024
+}
+
+//Reads the lines of a file oldest first, giving each to read until it returns false
+func readLines(file string, read func(line messages.ConsoleLine) bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for scanner.Scan() {
+		line := messages.ConsoleLine{}
+		//the line being written as this reads it is not complete yet
+		if json.Unmarshal(scanner.Bytes(), &line) == nil && !read(line) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
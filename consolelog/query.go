@@ -0,0 +1,200 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package consolelog
+
+import (
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/pufferd/messages"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Which lines to read from the log. Times are unix milliseconds, and zero values are not checked.
+type Query struct {
+	//Only lines before this sequence, to page back through the log
+	Before int64
+	//Only lines after this sequence, to catch up on what was missed
+	After  int64
+	From   int64
+	To     int64
+	Search *regexp.Regexp
+	Limit  int
+}
+
+type Result struct {
+	Lines []messages.ConsoleLine `json:"lines"`
+	//If there are older lines which match
+	More bool `json:"more"`
+}
+
+type logFile struct {
+	path    string
+	rotated time.Time
+}
+
+//Reads the newest lines matching the query, oldest first.
+//Files are read a line at a time, and only as many matches as the limit are kept.
+func (l *Log) Query(q Query) (Result, error) {
+	result := Result{Lines: make([]messages.ConsoleLine, 0)}
+	files, err := l.files()
+	if err != nil {
+		return result, err
+	}
+
+	for _, file := range files {
+		//files are rotated after their last line, so those rotated before the start and all older ones can be skipped
+		if q.From > 0 && !file.rotated.IsZero() && file.rotated.UnixNano()/int64(time.Millisecond) < q.From {
+			break
+		}
+
+		//one more line than the limit is kept, to know if there are more
+		matched := newLastLines(q.Limit + 1 - len(result.Lines))
+		first := true
+		older := false
+		err := readLines(file.path, func(line messages.ConsoleLine) bool {
+			//lines are in order, so a file starting before After or From has nothing older files could add
+			if first {
+				first = false
+				older = (q.After > 0 && line.Sequence <= q.After) || (q.From > 0 && line.Time < q.From)
+			}
+			//and the rest of the file is past Before or To once one line is
+			if (q.Before > 0 && line.Sequence >= q.Before) || (q.To > 0 && line.Time > q.To) {
+				return false
+			}
+			if q.matches(line) {
+				matched.add(line)
+			}
+			return true
+		})
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return result, err
+		}
+
+		result.Lines = append(matched.get(), result.Lines...)
+		if len(result.Lines) > q.Limit || older {
+			break
+		}
+	}
+
+	if len(result.Lines) > q.Limit {
+		result.More = true
+		result.Lines = result.Lines[len(result.Lines)-q.Limit:]
+	}
+	return result, nil
+}
+
+//Keeps the last lines added, up to a maximum
+type lastLines struct {
+	lines []messages.ConsoleLine
+	max   int
+	next  int
+}
+
+func newLastLines(max int) *lastLines {
+	return &lastLines{lines: make([]messages.ConsoleLine, 0), max: max}
+}
+
+func (l *lastLines) add(line messages.ConsoleLine) {
+	if l.max <= 0 {
+		return
+	}
+	if len(l.lines) < l.max {
+		l.lines = append(l.lines, line)
+		return
+	}
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % l.max
+}
+
+//Gets the lines, oldest first
+func (l *lastLines) get() []messages.ConsoleLine {
+	result := make([]messages.ConsoleLine, 0, len(l.lines))
+	result = append(result, l.lines[l.next:]...)
+	return append(result, l.lines[:l.next]...)
+}
+
+func (q Query) matches(line messages.ConsoleLine) bool {
+	if q.Before > 0 && line.Sequence >= q.Before {
+		return false
+	}
+	if q.After > 0 && line.Sequence <= q.After {
+		return false
+	}
+	if q.From > 0 && line.Time < q.From {
+		return false
+	}
+	if q.To > 0 && line.Time > q.To {
+		return false
+	}
+	return q.Search == nil || q.Search.MatchString(line.Message)
+}
+
+//Gets the files of the log, newest first.
+//A rotated file which has not been gzipped yet is used instead of the gzipped one, which may not be complete.
+func (l *Log) files() ([]logFile, error) {
+	entries, err := ioutil.ReadDir(l.folder)
+	if os.IsNotExist(err) {
+		return []logFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	current := false
+	rotated := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == currentFile {
+			current = true
+			continue
+		}
+		if !strings.HasPrefix(name, rotatedPrefix) {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".gz")
+		if !strings.HasSuffix(base, ".log") {
+			continue
+		}
+		if existing, ok := rotated[base]; !ok || strings.HasSuffix(existing, ".gz") {
+			rotated[base] = name
+		}
+	}
+
+	names := make([]string, 0, len(rotated))
+	for base := range rotated {
+		names = append(names, base)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	result := make([]logFile, 0, len(names)+1)
+	if current {
+		result = append(result, logFile{path: common.JoinPath(l.folder, currentFile)})
+	}
+	for _, base := range names {
+		at, err := time.ParseInLocation(rotatedLayout, strings.TrimSuffix(strings.TrimPrefix(base, rotatedPrefix), ".log"), time.UTC)
+		if err != nil {
+			continue
+		}
+		result = append(result, logFile{path: common.JoinPath(l.folder, rotated[base]), rotated: at})
+	}
+	return result, nil
+}
@@ -0,0 +1,333 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/config"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/messages"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Name the daemon is started under when it is holding a server back until it is in its cgroup
+const cgroupGateName = "pufferd-cgroup-gate"
+
+var cgroupControllers = []string{"cpu", "cpuset", "memory", "io", "pids"}
+
+//A cgroup v2 group holding every process of a server
+type cgroup struct {
+	path   string
+	limits ResourceLimits
+
+	locker    sync.Mutex
+	lastUsage uint64
+	lastCheck time.Time
+}
+
+//Creates the cgroup definition for a server, or nil if cgroups are not configured for this node.
+//The parent is expected to be a cgroup v2 group the daemon is allowed to manage, such as a delegated systemd slice.
+func newCgroup(id string, limits ResourceLimits) *cgroup {
+	parent := config.GetStringOrDefault("cgroupParent", "")
+	if parent == "" {
+		return nil
+	}
+	return &cgroup{path: common.JoinPath(parent, id), limits: limits}
+}
+
+//Holds a started server back until it has been moved into its group
+type cgroupGate struct {
+	cgroup *cgroup
+	reader *os.File
+	writer *os.File
+}
+
+func init() {
+	if filepath.Base(os.Args[0]) == cgroupGateName {
+		os.Exit(cgroupGateInit())
+	}
+}
+
+//Creates the group and applies the limits, then wraps the command so it waits to be moved into the group before it runs.
+//Everything the server starts is then in the group too. Once the command has started, the gate has to be opened or closed.
+//The daemon's own executable is what starts, as the run-as user, so it has to be executable by that user.
+func (c *cgroup) gate(cmd *exec.Cmd) (*cgroupGate, error) {
+	err := c.create()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	fd := 3 + len(cmd.ExtraFiles)
+	args := []string{cgroupGateName, strconv.Itoa(fd), cmd.Path}
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.ExtraFiles = append(cmd.ExtraFiles, reader)
+	return &cgroupGate{cgroup: c, reader: reader, writer: writer}, nil
+}
+
+//Moves the started process into the group and lets it run.
+//If it cannot be moved, it exits instead of running without its limits.
+func (g *cgroupGate) open(pid int) error {
+	g.reader.Close()
+	defer g.writer.Close()
+	err := g.cgroup.write("cgroup.procs", strconv.Itoa(pid))
+	if err != nil {
+		return err
+	}
+	_, err = g.writer.Write([]byte{1})
+	return err
+}
+
+//Releases the gate of a command which did not start
+func (g *cgroupGate) close() {
+	g.reader.Close()
+	g.writer.Close()
+}
+
+//Entry point of the gate, which waits until it is told it is in the group and then runs the server in its place.
+//Arguments are the file descriptor of the gate, then the path and arguments of the server.
+func cgroupGateInit() int {
+	args := os.Args[1:]
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "invalid cgroup gate arguments")
+		return 1
+	}
+
+	fd, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid cgroup gate arguments")
+		return 1
+	}
+	gate := os.NewFile(uintptr(fd), "cgroup gate")
+	n, _ := gate.Read(make([]byte, 1))
+	gate.Close()
+	if n != 1 {
+		fmt.Fprintln(os.Stderr, "server could not be placed in its cgroup")
+		return 1
+	}
+
+	err = syscall.Exec(args[1], args[2:], os.Environ())
+	fmt.Fprintln(os.Stderr, err.Error())
+	return 1
+}
+
+func (c *cgroup) create() error {
+	parent := common.JoinPath(c.path, "..")
+	for _, v := range cgroupControllers {
+		//controllers missing from the kernel are ignored, their limits just will not apply
+		if err := ioutil.WriteFile(common.JoinPath(parent, "cgroup.subtree_control"), []byte("+"+v), 0644); err != nil {
+			logging.Debugf("Could not enable cgroup controller %s: %s", v, err.Error())
+		}
+	}
+
+	err := os.Mkdir(c.path, 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return c.apply()
+}
+
+func (c *cgroup) setLimits(limits ResourceLimits) error {
+	c.limits = limits
+	if _, err := os.Stat(c.path); os.IsNotExist(err) {
+		return nil
+	}
+	return c.apply()
+}
+
+//Converts the limits to the cgroup v2 interface, using the same conversions as the container runtimes
+func (c *cgroup) apply() error {
+	limits := c.limits
+
+	if err := c.write("memory.max", limitOrMax(limits.Memory)); err != nil {
+		return err
+	}
+
+	//the swap setting includes memory, as it does for docker
+	swap := "max"
+	if limits.MemorySwap > 0 && limits.Memory > 0 && limits.MemorySwap >= limits.Memory {
+		swap = strconv.FormatInt(limits.MemorySwap-limits.Memory, 10)
+	}
+	if err := c.write("memory.swap.max", swap); err != nil {
+		return err
+	}
+
+	period := limits.CpuPeriod
+	if period == 0 {
+		period = 100000
+	}
+	if err := c.write("cpu.max", fmt.Sprintf("%s %d", limitOrMax(limits.CpuQuota), period)); err != nil {
+		return err
+	}
+
+	weight := int64(100)
+	if limits.CpuShares > 0 {
+		weight = 1 + ((limits.CpuShares-2)*9999)/262142
+	}
+	if err := c.write("cpu.weight", strconv.FormatInt(weight, 10)); err != nil {
+		return err
+	}
+
+	if err := c.write("cpuset.cpus", limits.Cpuset); err != nil {
+		return err
+	}
+
+	if err := c.write("pids.max", limitOrMax(limits.PidsLimit)); err != nil {
+		return err
+	}
+
+	ioWeight := int64(100)
+	if limits.BlkioWeight > 0 {
+		ioWeight = 1 + ((int64(limits.BlkioWeight)-10)*9999)/990
+	}
+	return c.write("io.weight", "default "+strconv.FormatInt(ioWeight, 10))
+}
+
+//Reads usage for the whole group, so child processes are included
+func (c *cgroup) stats() (*messages.StatMessage, error) {
+	stats := &messages.StatMessage{}
+
+	memory, err := c.readInt("memory.current")
+	if err != nil {
+		return nil, err
+	}
+	stats.Memory = float64(memory)
+
+	cpuStats, err := c.readKeyed("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	stats.Cpu = c.cpuPercent(cpuStats["usage_usec"])
+
+	ioStats, err := c.readKeyed("io.stat")
+	if err == nil {
+		stats.DiskRead = float64(ioStats["rbytes"])
+		stats.DiskWrite = float64(ioStats["wbytes"])
+	}
+
+	return stats, nil
+}
+
+//Works out CPU usage since the last sample, sampling twice if there is none yet
+func (c *cgroup) cpuPercent(usage uint64) float64 {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	now := time.Now()
+	if c.lastCheck.IsZero() || usage < c.lastUsage {
+		c.lastUsage = usage
+		c.lastCheck = now
+		time.Sleep(time.Millisecond * 50)
+		cpuStats, err := c.readKeyed("cpu.stat")
+		if err != nil {
+			return 0
+		}
+		usage = cpuStats["usage_usec"]
+		now = time.Now()
+	}
+
+	elapsed := now.Sub(c.lastCheck).Nanoseconds() / 1000
+	delta := usage - c.lastUsage
+	c.lastUsage = usage
+	c.lastCheck = now
+
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(delta) / float64(elapsed) * 100
+}
+
+//Removes the group, which only succeeds once every process in it has exited
+func (c *cgroup) destroy() {
+	c.locker.Lock()
+	c.lastCheck = time.Time{}
+	c.locker.Unlock()
+
+	err := os.Remove(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		logging.Error("Error removing cgroup "+c.path, err)
+	}
+}
+
+func (c *cgroup) write(file, value string) error {
+	err := ioutil.WriteFile(common.JoinPath(c.path, file), []byte(value), 0644)
+	//files for disabled controllers do not exist
+	if os.IsNotExist(err) {
+		logging.Debugf("Cgroup file %s does not exist, limit not applied", file)
+		return nil
+	}
+	return err
+}
+
+func (c *cgroup) readInt(file string) (uint64, error) {
+	data, err := ioutil.ReadFile(common.JoinPath(c.path, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+//Reads a file of "key value" lines, or "device key=value ..." lines which are summed across devices
+func (c *cgroup) readKeyed(file string) (map[string]uint64, error) {
+	f, err := os.Open(common.JoinPath(c.path, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.Contains(fields[1], "=") {
+			result[fields[0]], _ = strconv.ParseUint(fields[1], 10, 64)
+			continue
+		}
+		for _, field := range fields {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, _ := strconv.ParseUint(parts[1], 10, 64)
+			result[parts[0]] += value
+		}
+	}
+	return result, scanner.Err()
+}
+
+func limitOrMax(value int64) string {
+	if value <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(value, 10)
+}
@@ -0,0 +1,58 @@
+// +build !linux
+
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"errors"
+	"github.com/pufferpanel/pufferd/messages"
+	"os/exec"
+)
+
+//cgroups only exist on linux, so servers are never placed in one
+type cgroup struct {
+}
+
+func newCgroup(id string, limits ResourceLimits) *cgroup {
+	return nil
+}
+
+type cgroupGate struct {
+}
+
+func (c *cgroup) gate(cmd *exec.Cmd) (*cgroupGate, error) {
+	return nil, errors.New("cgroups are not supported on this platform")
+}
+
+func (g *cgroupGate) open(pid int) error {
+	return errors.New("cgroups are not supported on this platform")
+}
+
+func (g *cgroupGate) close() {
+}
+
+func (c *cgroup) setLimits(limits ResourceLimits) error {
+	return errors.New("cgroups are not supported on this platform")
+}
+
+func (c *cgroup) stats() (*messages.StatMessage, error) {
+	return nil, errors.New("cgroups are not supported on this platform")
+}
+
+func (c *cgroup) destroy() {
+}
@@ -0,0 +1,147 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"bytes"
+	"github.com/pufferpanel/pufferd/cache"
+	"github.com/pufferpanel/pufferd/messages"
+	"time"
+)
+
+const (
+	//how long output without a newline waits for the rest of its line before it is shown on its own
+	partialDelay = 100 * time.Millisecond
+
+	//longest a line can get before it is shown without waiting for the rest of it
+	maxLineLength = 64 * 1024
+)
+
+//Writes output from a source to the console of the environment
+type consoleWriter struct {
+	environment *BaseEnvironment
+	source      string
+}
+
+func (w consoleWriter) Write(p []byte) (int, error) {
+	w.environment.writeConsole(w.source, p)
+	return len(p), nil
+}
+
+//Splits the output into lines and shows each of them.
+//Everything written while a job is running comes from that job, so it is shown as install output.
+func (e *BaseEnvironment) writeConsole(source string, p []byte) {
+	if e.GetJob() != nil {
+		source = messages.SourceInstall
+	}
+
+	e.consoleLocker.Lock()
+	defer e.consoleLocker.Unlock()
+	if e.consolePartial == nil {
+		e.consolePartial = make(map[string][]byte)
+	}
+
+	now := time.Now()
+	data := append(e.consolePartial[source], p...)
+	lines := make([]messages.ConsoleLine, 0)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		lines = append(lines, e.newLine(now, source, string(bytes.TrimSuffix(data[:i], []byte("\r"))), false))
+		data = data[i+1:]
+	}
+	if len(data) > maxLineLength {
+		lines = append(lines, e.newLine(now, source, string(data), true))
+		data = nil
+	}
+
+	if len(data) > 0 {
+		e.consolePartial[source] = append([]byte{}, data...)
+		if e.consoleFlush == nil {
+			e.consoleFlush = time.AfterFunc(partialDelay, e.flushConsole)
+		}
+	} else {
+		delete(e.consolePartial, source)
+	}
+
+	e.showLines(lines)
+}
+
+//Shows the output which is still waiting for the rest of its line, such as a prompt
+func (e *BaseEnvironment) flushConsole() {
+	e.consoleLocker.Lock()
+	defer e.consoleLocker.Unlock()
+	e.consoleFlush = nil
+
+	now := time.Now()
+	lines := make([]messages.ConsoleLine, 0, len(e.consolePartial))
+	for source, data := range e.consolePartial {
+		lines = append(lines, e.newLine(now, source, string(data), true))
+	}
+	e.consolePartial = nil
+	e.showLines(lines)
+}
+
+func (e *BaseEnvironment) newLine(now time.Time, source, message string, partial bool) messages.ConsoleLine {
+	e.consoleSequence++
+	return messages.ConsoleLine{
+		Sequence: e.consoleSequence,
+		Time:     now.UnixNano() / int64(time.Millisecond),
+		Source:   source,
+		Message:  message,
+		Partial:  partial,
+	}
+}
+
+//Sends the lines to everything which shows the console. This is called with the console locked, so lines stay in order.
+func (e *BaseEnvironment) showLines(lines []messages.ConsoleLine) {
+	if len(lines) == 0 {
+		return
+	}
+
+	logs := make([]string, len(lines))
+	for i, line := range lines {
+		logs[i] = line.Text()
+		e.ConsoleBuffer.Write([]byte(logs[i]))
+		jobWriter{e}.Write([]byte(logs[i]))
+		if e.ConsoleLog != nil {
+			e.ConsoleLog.WriteLine(line)
+		}
+	}
+	e.WSManager.WriteMessage(messages.ConsoleMessage{Logs: logs, Lines: lines})
+
+	e.consoleLines = append(e.consoleLines, lines...)
+	if size := cache.GetConsoleBufferSize(); len(e.consoleLines) > size {
+		e.consoleLines = append([]messages.ConsoleLine{}, e.consoleLines[len(e.consoleLines)-size:]...)
+	}
+}
+
+//Gets the lines still in the buffer after the sequence, or all of them for 0
+func (e *BaseEnvironment) GetConsoleLines(after int64) []messages.ConsoleLine {
+	e.consoleLocker.Lock()
+	defer e.consoleLocker.Unlock()
+
+	result := make([]messages.ConsoleLine, 0, len(e.consoleLines))
+	for _, line := range e.consoleLines {
+		if line.Sequence > after {
+			result = append(result, line)
+		}
+	}
+	return result
+}
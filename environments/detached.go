@@ -0,0 +1,243 @@
+// +build !windows
+
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"encoding/json"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/shirou/gopsutil/process"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//how much output which has been read is left in the log before it is discarded
+const detachedLogLimit = 1024 * 1024
+
+//A process which was started detached from the daemon.
+//Output goes to a log file and input comes from a fifo, so the process survives the daemon restarting.
+type detachedProcess struct {
+	Pid     int   `json:"pid"`
+	Created int64 `json:"created"`
+
+	stateFile string
+	done      chan bool
+}
+
+func newDetachedProcess(stateFile string) *detachedProcess {
+	return &detachedProcess{stateFile: stateFile}
+}
+
+func (d *detachedProcess) pidFile() string {
+	return d.stateFile + ".pid"
+}
+
+func (d *detachedProcess) logFile() string {
+	return d.stateFile + ".log"
+}
+
+func (d *detachedProcess) stdinFile() string {
+	return d.stateFile + ".stdin"
+}
+
+//Prepares the command to run detached and starts it.
+//The returned writer sends to the stdin of the process.
+func (d *detachedProcess) start(cmd *exec.Cmd, output io.Writer) (stdin io.WriteCloser, err error) {
+	err = os.MkdirAll(filepath.Dir(d.stateFile), 0755)
+	if err != nil {
+		return
+	}
+
+	os.Remove(d.stdinFile())
+	err = syscall.Mkfifo(d.stdinFile(), 0600)
+	if err != nil {
+		return
+	}
+
+	//the process holds both ends of the fifo, so it never sees the end of its input while the daemon is away
+	in, err := os.OpenFile(d.stdinFile(), os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(d.logFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	d.Pid = cmd.Process.Pid
+	if proc, pErr := process.NewProcess(int32(d.Pid)); pErr == nil {
+		d.Created, _ = proc.CreateTime()
+	}
+
+	data, err := json.Marshal(d)
+	if err == nil {
+		err = ioutil.WriteFile(d.pidFile(), data, 0644)
+	}
+	if err != nil {
+		logging.Error("Error writing pid file", err)
+	}
+
+	return d.attach(output, 0)
+}
+
+//Finds a detached process left behind by a previous run of the daemon.
+//Returns nil if there is no such process, or it has since exited.
+func (d *detachedProcess) find() *os.Process {
+	data, err := ioutil.ReadFile(d.pidFile())
+	if err != nil {
+		return nil
+	}
+
+	err = json.Unmarshal(data, d)
+	if err != nil || d.Pid == 0 {
+		d.cleanup()
+		return nil
+	}
+
+	//the pid may have been reused, so the start time has to match too
+	proc, err := process.NewProcess(int32(d.Pid))
+	if err != nil {
+		d.cleanup()
+		return nil
+	}
+	if created, err := proc.CreateTime(); err != nil || created != d.Created {
+		d.cleanup()
+		return nil
+	}
+
+	result, err := os.FindProcess(d.Pid)
+	if err != nil || result.Signal(syscall.Signal(0)) != nil {
+		d.cleanup()
+		return nil
+	}
+	return result
+}
+
+//Connects to the input and output of a running detached process.
+//Output is read from the given offset of the log file until stop is called.
+func (d *detachedProcess) attach(output io.Writer, offset int64) (stdin io.WriteCloser, err error) {
+	//non-blocking, as this fails instead of hanging when the process has already exited
+	stdin, err = os.OpenFile(d.stdinFile(), os.O_WRONLY|syscall.O_NONBLOCK, 0600)
+	if err != nil {
+		return
+	}
+
+	//writable, so output which has been read can be discarded
+	log, err := os.OpenFile(d.logFile(), os.O_RDWR, 0644)
+	if err != nil {
+		stdin.Close()
+		return
+	}
+	if offset != 0 {
+		log.Seek(offset, io.SeekStart)
+	}
+
+	d.done = make(chan bool)
+	go tailLog(log, offset, output, d.done)
+	return
+}
+
+//Reattaches to output at the end of the log, so it is not replayed
+func (d *detachedProcess) reattach(output io.Writer) (stdin io.WriteCloser, err error) {
+	var offset int64
+	if info, err := os.Stat(d.logFile()); err == nil {
+		offset = info.Size()
+	}
+	return d.attach(output, offset)
+}
+
+//Stops following the output and removes the state of the process
+func (d *detachedProcess) stop() {
+	if d.done != nil {
+		d.done <- true
+		d.done = nil
+	}
+	d.cleanup()
+}
+
+func (d *detachedProcess) cleanup() {
+	os.Remove(d.pidFile())
+	os.Remove(d.stdinFile())
+}
+
+//Waits for a process the daemon is not the parent of, as it cannot be waited on
+func waitForDetached(proc *os.Process) {
+	for proc.Signal(syscall.Signal(0)) == nil {
+		time.Sleep(time.Second)
+	}
+}
+
+func tailLog(log *os.File, offset int64, output io.Writer, done chan bool) {
+	defer log.Close()
+	buf := make([]byte, 4096)
+	stopping := false
+	//start of the output which has not been discarded yet
+	var kept int64
+	for {
+		n, err := log.Read(buf)
+		if n > 0 {
+			output.Write(buf[:n])
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			if stopping {
+				return
+			}
+			//the output has been shown already, so it does not need to take up space
+			if offset-kept >= detachedLogLimit {
+				if offset, err = discardLog(log, offset); err != nil {
+					logging.Error("Error discarding process output", err)
+				}
+				kept = offset
+			}
+			select {
+			case <-done:
+				//read whatever was written before the process exited
+				stopping = true
+			case <-time.After(100 * time.Millisecond):
+			}
+		} else if err != nil {
+			logging.Error("Error reading process output", err)
+			if !stopping {
+				<-done
+			}
+			return
+		}
+	}
+}
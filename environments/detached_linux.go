@@ -0,0 +1,33 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+//Frees the space of the output before offset, which the process may still be appending to.
+//Punching a hole keeps offsets as they are, so nothing written meanwhile is lost.
+func discardLog(log *os.File, offset int64) (int64, error) {
+	return offset, syscall.Fallocate(int(log.Fd()), fallocPunchHole|fallocKeepSize, 0, offset)
+}
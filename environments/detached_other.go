@@ -0,0 +1,33 @@
+// +build !linux,!windows
+
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"io"
+	"os"
+)
+
+//Empties the log once all of it has been read, as holes cannot be punched here.
+//Output the process writes between the last read and this is lost.
+func discardLog(log *os.File, offset int64) (int64, error) {
+	if err := log.Truncate(0); err != nil {
+		return offset, err
+	}
+	return log.Seek(0, io.SeekStart)
+}
@@ -0,0 +1,49 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+type detachedProcess struct {
+}
+
+func newDetachedProcess(stateFile string) *detachedProcess {
+	return &detachedProcess{}
+}
+
+func (d *detachedProcess) start(cmd *exec.Cmd, output io.Writer) (stdin io.WriteCloser, err error) {
+	return nil, errors.New("detached processes are not supported on windows")
+}
+
+func (d *detachedProcess) find() *os.Process {
+	return nil
+}
+
+func (d *detachedProcess) reattach(output io.Writer) (stdin io.WriteCloser, err error) {
+	return nil, errors.New("detached processes are not supported on windows")
+}
+
+func (d *detachedProcess) stop() {
+}
+
+func waitForDetached(proc *os.Process) {
+}
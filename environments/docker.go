@@ -21,6 +21,7 @@ import (
 	"errors"
 	"github.com/pufferpanel/apufferi/cache"
 	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/config"
 	"github.com/pufferpanel/pufferd/utils"
 	"sync"
 
@@ -32,12 +33,16 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 	"github.com/pufferpanel/apufferi/logging"
 	ppError "github.com/pufferpanel/pufferd/errors"
+	"github.com/pufferpanel/pufferd/messages"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -49,7 +54,8 @@ type docker struct {
 	connection       types.HijackedResponse
 	cli              *client.Client
 	downloadingImage bool
-	enforceNetwork   bool
+	networkMode      string
+	resources        ResourceLimits
 }
 
 func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) error {
@@ -85,6 +91,22 @@ func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]st
 		}
 	}
 
+	err = d.attach(client, ctx, callback)
+	if err != nil {
+		return err
+	}
+
+	startOpts := types.ContainerStartOptions{}
+
+	err = client.ContainerStart(ctx, d.ContainerId, startOpts)
+	if err != nil {
+		return err
+	}
+	return err
+}
+
+//Attaches to the stdio of the container, calling back once the container has exited
+func (d *docker) attach(client *client.Client, ctx context.Context, callback func(graceful bool)) (err error) {
 	config := types.ContainerAttachOptions{
 		Stdin:  true,
 		Stdout: true,
@@ -97,28 +119,54 @@ func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]st
 		return err
 	}
 
+	//waited on before the container exits, as it is removed once it has
+	exited, waitErr := client.ContainerWait(context.Background(), d.ContainerId, container.WaitConditionNextExit)
+
 	d.wait.Add(1)
 
 	go func() {
 		defer d.connection.Close()
-		wrapper := d.createWrapper()
+		wrapper := io.MultiWriter(d.createWrapper(messages.SourceStdout), terminalWriter{d.BaseEnvironment})
 		io.Copy(wrapper, d.connection.Reader)
 		c, _ := d.getClient()
 		c.ContainerStop(context.Background(), d.ContainerId, nil)
+
+		graceful := false
+		select {
+		case result := <-exited:
+			graceful = result.StatusCode == 0
+		case err := <-waitErr:
+			logging.Error("Error reading exit code of container "+d.ContainerId, err)
+		}
+
 		time.Sleep(1 * time.Second)
 		d.wait.Done()
 		if callback != nil {
-			callback(true)
+			callback(graceful)
 		}
 	}()
+	return
+}
 
-	startOpts := types.ContainerStartOptions{}
+//Programs other than the server would run on the host without the container around them, so they are refused
+func (d *docker) RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	return errors.New("the docker environment cannot run programs outside of its container")
+}
 
-	err = client.ContainerStart(ctx, d.ContainerId, startOpts)
+func (d *docker) Reattach(callback func(graceful bool)) (attached bool, err error) {
+	running, err := d.IsRunning()
+	if err != nil || !running {
+		return
+	}
+
+	client, err := d.getClient()
 	if err != nil {
-		return err
+		return
 	}
-	return err
+
+	logging.Debugf("Reattaching to container %s", d.ContainerId)
+	err = d.attach(client, context.Background(), callback)
+	return err == nil, err
 }
 
 func (d *docker) ExecuteInMainProcess(cmd string) (err error) {
@@ -135,6 +183,37 @@ func (d *docker) ExecuteInMainProcess(cmd string) (err error) {
 	return
 }
 
+func (d *docker) WriteTerminal(data []byte) (err error) {
+	running, err := d.IsRunning()
+	if err != nil {
+		return
+	}
+	if !running {
+		err = errors.New("main process has not been started")
+		return
+	}
+
+	_, err = d.connection.Conn.Write(data)
+	return
+}
+
+func (d *docker) ResizeTerminal(cols, rows uint16) (err error) {
+	running, err := d.IsRunning()
+	if err != nil {
+		return
+	}
+	if !running {
+		err = errors.New("main process has not been started")
+		return
+	}
+
+	client, err := d.getClient()
+	if err != nil {
+		return
+	}
+	return client.ContainerResize(context.Background(), d.ContainerId, types.ResizeOptions{Height: uint(rows), Width: uint(cols)})
+}
+
 func (d *docker) Kill() (err error) {
 	running, err := d.IsRunning()
 	if err != nil {
@@ -157,6 +236,11 @@ func (d *docker) Create() error {
 		return err
 	}
 
+	err = d.ResetOwnership()
+	if err != nil {
+		return err
+	}
+
 	go func() {
 		cli, err := d.getClient()
 		if err != nil {
@@ -190,7 +274,7 @@ func (d *docker) IsRunning() (bool, error) {
 	return stats.State.Running, nil
 }
 
-func (d *docker) GetStats() (map[string]interface{}, error) {
+func (d *docker) GetStats() (*messages.StatMessage, error) {
 	running, err := d.IsRunning()
 	if err != nil {
 		return nil, err
@@ -213,16 +297,55 @@ func (d *docker) GetStats() (map[string]interface{}, error) {
 
 	defer res.Body.Close()
 
-	data := make(map[string]interface{})
+	data := types.StatsJSON{}
 	err = json.NewDecoder(res.Body).Decode(&data)
 	if err != nil {
 		return nil, err
 	}
 
-	resultMap := make(map[string]interface{})
-	resultMap["memory"] = 0
-	resultMap["cpu"] = 0
-	return resultMap, nil
+	return convertDockerStats(data), nil
+}
+
+func convertDockerStats(data types.StatsJSON) *messages.StatMessage {
+	stats := &messages.StatMessage{}
+
+	//cpu usage is reported as a running total, so we need the delta against the previous sample
+	cpuDelta := float64(data.CPUStats.CPUUsage.TotalUsage) - float64(data.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(data.CPUStats.SystemUsage) - float64(data.PreCPUStats.SystemUsage)
+	onlineCpus := float64(data.CPUStats.OnlineCPUs)
+	if onlineCpus == 0 {
+		onlineCpus = float64(len(data.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.Cpu = (cpuDelta / systemDelta) * onlineCpus * 100
+	}
+
+	//page cache is reclaimable, so it should not count against the server
+	memory := data.MemoryStats.Usage
+	pageCache, ok := data.MemoryStats.Stats["cache"]
+	if !ok {
+		pageCache = data.MemoryStats.Stats["inactive_file"]
+	}
+	if pageCache < memory {
+		memory -= pageCache
+	}
+	stats.Memory = float64(memory)
+
+	for _, v := range data.Networks {
+		stats.NetworkRx += float64(v.RxBytes)
+		stats.NetworkTx += float64(v.TxBytes)
+	}
+
+	for _, v := range data.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(v.Op) {
+		case "read":
+			stats.DiskRead += float64(v.Value)
+		case "write":
+			stats.DiskWrite += float64(v.Value)
+		}
+	}
+
+	return stats
 }
 
 func (e *docker) WaitForMainProcess() error {
@@ -307,15 +430,19 @@ func (d *docker) pullImage(client *client.Client, ctx context.Context, force boo
 	d.DisplayToConsole("Downloading image for container, please wait\n")
 
 	d.downloadingImage = true
+	d.notifyDownload(true)
+	defer func() {
+		d.downloadingImage = false
+		d.notifyDownload(false)
+	}()
 
 	r, err := client.ImagePull(ctx, d.ImageName, op)
-	defer r.Close()
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 	_, err = io.Copy(ioutil.Discard, r)
 
-	d.downloadingImage = false
 	logging.Debugf("Downloaded image %v", d.ImageName)
 	d.DisplayToConsole("Downloaded image for container\n")
 	return err
@@ -336,9 +463,8 @@ func (d *docker) createContainer(client *client.Client, ctx context.Context, cmd
 		cmdSlice = append(cmdSlice, v)
 	}
 
-	newEnv := os.Environ()
-	//newEnv["home"] = root
-	newEnv = append(newEnv, "HOME="+root)
+	//the image provides its own environment, so nothing is passed on from the daemon
+	newEnv := []string{"HOME=" + root}
 	for k, v := range env {
 		newEnv = append(newEnv, fmt.Sprintf("%s=%s", k, v))
 	}
@@ -358,22 +484,132 @@ func (d *docker) createContainer(client *client.Client, ctx context.Context, cmd
 
 	if runtime.GOOS == "linux" {
 		config.User = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+
+		user, err := d.getRunAs()
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			config.User = fmt.Sprintf("%d:%d", user.uid, user.gid)
+		}
 	}
 
 	hostConfig := &container.HostConfig{
 		AutoRemove:  true,
-		NetworkMode: "host",
-		Resources:   container.Resources{},
+		NetworkMode: container.NetworkMode(d.networkMode),
+		Resources:   d.containerResources(),
 		Binds:       make([]string, 0),
 	}
 	hostConfig.Binds = append(hostConfig.Binds, root+":"+root)
 
 	networkConfig := &network.NetworkingConfig{}
 
+	switch d.networkMode {
+	case "host":
+	case "none":
+		config.NetworkDisabled = true
+	default:
+		if d.networkMode != "bridge" {
+			err = d.ensureNetwork(client, ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		config.ExposedPorts, hostConfig.PortBindings, err = nat.ParsePortSpecs(d.getPortSpecs())
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = client.ContainerCreate(ctx, config, hostConfig, networkConfig, d.ContainerId)
 	return err
 }
 
+//Creates the named network the container should join if it does not exist yet
+func (d *docker) ensureNetwork(client *client.Client, ctx context.Context) error {
+	opts := types.NetworkListOptions{
+		Filters: filters.NewArgs(),
+	}
+	opts.Filters.Add("name", d.networkMode)
+
+	existingNetworks, err := client.NetworkList(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	//name filters match on substrings, so the exact name has to be checked
+	for _, v := range existingNetworks {
+		if v.Name == d.networkMode {
+			return nil
+		}
+	}
+
+	logging.Debugf("Creating docker network %s", d.networkMode)
+	_, err = client.NetworkCreate(ctx, d.networkMode, types.NetworkCreate{CheckDuplicate: true, Driver: "bridge"})
+	return err
+}
+
+//Converts the ports of the server into docker port specs, publishing each port under the same number on the host
+func (d *docker) getPortSpecs() []string {
+	specs := make([]string, 0)
+	for _, v := range d.Ports {
+		protocol := "tcp"
+		if i := strings.LastIndex(v, "/"); i != -1 {
+			v, protocol = v[:i], v[i+1:]
+		}
+
+		ip := ""
+		port := v
+		if i := strings.LastIndex(v, ":"); i != -1 {
+			ip, port = v[:i], v[i+1:]
+		}
+
+		if port == "" || port == "0" {
+			continue
+		}
+
+		if ip == "" {
+			specs = append(specs, fmt.Sprintf("%s:%s/%s", port, port, protocol))
+		} else {
+			specs = append(specs, fmt.Sprintf("%s:%s:%s/%s", ip, port, port, protocol))
+		}
+	}
+	return specs
+}
+
+func (d *docker) SetResourceLimits(limits ResourceLimits) error {
+	d.resources = limits
+
+	client, err := d.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	exists, err := d.doesContainerExist(client, ctx)
+	if err != nil || !exists {
+		return err
+	}
+
+	logging.Debugf("Updating resource limits for container %s", d.ContainerId)
+	_, err = client.ContainerUpdate(ctx, d.ContainerId, container.UpdateConfig{Resources: d.containerResources()})
+	return err
+}
+
+func (d *docker) containerResources() container.Resources {
+	return container.Resources{
+		Memory:      d.resources.Memory,
+		MemorySwap:  d.resources.MemorySwap,
+		CPUQuota:    d.resources.CpuQuota,
+		CPUPeriod:   d.resources.CpuPeriod,
+		CPUShares:   d.resources.CpuShares,
+		CpusetCpus:  d.resources.Cpuset,
+		PidsLimit:   d.resources.PidsLimit,
+		BlkioWeight: d.resources.BlkioWeight,
+	}
+}
+
 func (e *docker) SendCode(code int) error {
 	running, err := e.IsRunning()
 
@@ -395,7 +631,7 @@ type DockerFactory struct {
 	EnvironmentFactory
 }
 
-func (df DockerFactory) Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) Environment {
+func (df DockerFactory) Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) (Environment, error) {
 	imageName := common.GetStringOrDefault(environmentSection, "image", "")
 	enforceNetwork := common.GetBooleanOrDefault(environmentSection, "enforceNetwork", false)
 
@@ -403,7 +639,19 @@ func (df DockerFactory) Create(folder, id string, environmentSection map[string]
 		imageName = "pufferpanel/generic"
 	}
 
-	d := &docker{BaseEnvironment: &BaseEnvironment{Type: "docker"}, ContainerId: id, ImageName: imageName, enforceNetwork: enforceNetwork}
+	//enforcing the network means only the server's own ports are reachable, which needs a bridge
+	networkMode := "host"
+	if enforceNetwork {
+		networkMode = "bridge"
+	}
+	networkMode = common.GetStringOrDefault(environmentSection, "networkMode", networkMode)
+
+	resources, err := ParseResourceLimits(environmentSection)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &docker{BaseEnvironment: &BaseEnvironment{Type: "docker"}, ContainerId: id, ImageName: imageName, networkMode: networkMode, resources: resources}
 	d.BaseEnvironment.executeAsync = d.dockerExecuteAsync
 	d.BaseEnvironment.waitForMainProcess = d.WaitForMainProcess
 	d.wait = sync.WaitGroup{}
@@ -411,7 +659,9 @@ func (df DockerFactory) Create(folder, id string, environmentSection map[string]
 	d.RootDirectory = rootDirectory
 	d.ConsoleBuffer = cache
 	d.WSManager = wsManager
-	return d
+	d.configureUser(environmentSection)
+	d.Detached = common.GetBooleanOrDefault(environmentSection, "detached", config.GetBoolOrDefault("detachProcesses", false))
+	return d, nil
 }
 
 func (df DockerFactory) Key() string {
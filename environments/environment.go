@@ -17,14 +17,22 @@
 package environments
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"github.com/pufferpanel/apufferi/cache"
+	"github.com/pufferpanel/apufferi/common"
 	"github.com/pufferpanel/apufferi/config"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/consolelog"
+	"github.com/pufferpanel/pufferd/messages"
 	"github.com/pufferpanel/pufferd/utils"
 	"io"
 	"os"
+	"os/exec"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Environment interface {
@@ -60,22 +68,82 @@ type Environment interface {
 
 	GetConsoleFrom(time int64) (console []string, epoch int64)
 
-	AddListener(ws *websocket.Conn)
+	//Sets the log the console is also written to, which keeps it after the buffer is full and across restarts
+	SetConsoleLog(log *consolelog.Log)
 
-	GetStats() (map[string]interface{}, error)
+	//Reads lines from the console log, going back further than the buffer
+	GetConsoleHistory(query consolelog.Query) (consolelog.Result, error)
+
+	//Gets the lines in the buffer after the sequence, so a client can carry on from the last line it saw
+	GetConsoleLines(after int64) []messages.ConsoleLine
+
+	AddListener(ws *utils.Connection)
+
+	RemoveListener(ws *utils.Connection)
+
+	GetStats() (*messages.StatMessage, error)
 
 	DisplayToConsole(msg string, data ...interface{})
 
 	SendCode(code int) error
+
+	//Applies resource limits to the environment, including the running process if possible
+	SetResourceLimits(limits ResourceLimits) error
+
+	//Sets the ports the program listens on, in [ip:]port[/protocol] form.
+	//Environments which isolate the network use this to publish them.
+	SetPorts(ports []string)
+
+	//Attaches to the main process if it is still running from a previous run of the daemon.
+	Reattach(callback func(graceful bool)) (attached bool, err error)
+
+	//Determines if the main process is left running when the daemon shuts down.
+	IsDetached() bool
+
+	//Gives the user the program runs as ownership of all files of the environment.
+	ResetOwnership() (err error)
+
+	//Runs a program other than the main process, such as an operation module, as the user the program runs as,
+	//with the same environment variables and resource limits. It is killed with everything it started once the context is done.
+	//Environments which cannot give it the same limits refuse to run it.
+	RunCommand(ctx context.Context, cmd *exec.Cmd) (err error)
+
+	//Sends a message to everyone listening to the console.
+	BroadcastMessage(msg messages.Message)
+
+	//Sets the function told when the environment starts and finishes downloading what it needs to run, such as an image.
+	SetDownloadListener(listener func(downloading bool))
+
+	//Sets the job running in the environment, or nil once it is done
+	SetJob(job Job)
+
+	GetJob() Job
 }
 
 type BaseEnvironment struct {
 	Environment
 	RootDirectory      string                 `json:"-"`
 	ConsoleBuffer      cache.Cache            `json:"-"`
+	ConsoleLog         *consolelog.Log        `json:"-"`
 	WSManager          utils.WebSocketManager `json:"-"`
 	wait               sync.WaitGroup
-	Type               string `json:"type"`
+	Type               string   `json:"type"`
+	Ports              []string `json:"-"`
+	Detached           bool     `json:"-"`
+	runAsUser          string
+	runAsGroup         string
+	killTimeout        time.Duration
+	downloadListener   func(downloading bool)
+	job                Job
+	jobLocker          sync.RWMutex
+	consoleLocker      sync.Mutex
+	consoleSequence    int64
+	consolePartial     map[string][]byte
+	consoleFlush       *time.Timer
+	consoleLines       []messages.ConsoleLine
+	terminals          []*utils.Connection
+	terminalOutput     []byte
+	terminalLocker     sync.Mutex
 	executeAsync       func(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error)
 	waitForMainProcess func() (err error)
 }
@@ -112,17 +180,49 @@ func (e *BaseEnvironment) GetConsoleFrom(time int64) (console []string, epoch in
 	return
 }
 
-func (e *BaseEnvironment) AddListener(ws *websocket.Conn) {
+func (e *BaseEnvironment) SetConsoleLog(log *consolelog.Log) {
+	e.consoleLocker.Lock()
+	defer e.consoleLocker.Unlock()
+	e.ConsoleLog = log
+	if log != nil && log.LastSequence() > e.consoleSequence {
+		e.consoleSequence = log.LastSequence()
+	}
+}
+
+func (e *BaseEnvironment) GetConsoleHistory(query consolelog.Query) (consolelog.Result, error) {
+	if e.ConsoleLog == nil {
+		return consolelog.Result{}, consolelog.ErrDisabled
+	}
+	return e.ConsoleLog.Query(query)
+}
+
+func (e *BaseEnvironment) AddListener(ws *utils.Connection) {
 	e.WSManager.Register(ws)
 }
 
+func (e *BaseEnvironment) RemoveListener(ws *utils.Connection) {
+	e.WSManager.Unregister(ws)
+}
+
 func (e *BaseEnvironment) DisplayToConsole(msg string, data ...interface{}) {
 	if len(data) == 0 {
-		fmt.Fprint(e.ConsoleBuffer, msg)
-		fmt.Fprint(e.WSManager, msg)
+		fmt.Fprint(consoleWriter{e, messages.SourceDaemon}, msg)
 	} else {
-		fmt.Fprintf(e.ConsoleBuffer, msg, data...)
-		fmt.Fprintf(e.WSManager, msg, data...)
+		fmt.Fprintf(consoleWriter{e, messages.SourceDaemon}, msg, data...)
+	}
+}
+
+func (e *BaseEnvironment) BroadcastMessage(msg messages.Message) {
+	e.WSManager.WriteMessage(msg)
+}
+
+func (e *BaseEnvironment) SetDownloadListener(listener func(downloading bool)) {
+	e.downloadListener = listener
+}
+
+func (e *BaseEnvironment) notifyDownload(downloading bool) {
+	if e.downloadListener != nil {
+		e.downloadListener(downloading)
 	}
 }
 
@@ -130,14 +230,163 @@ func (e *BaseEnvironment) Update() error {
 	return nil
 }
 
+func (e *BaseEnvironment) SetResourceLimits(limits ResourceLimits) error {
+	return errors.New("resource limits are not supported by the " + e.Type + " environment")
+}
+
+func (e *BaseEnvironment) SetPorts(ports []string) {
+	e.Ports = ports
+}
+
+func (e *BaseEnvironment) Reattach(callback func(graceful bool)) (bool, error) {
+	return false, nil
+}
+
+func (e *BaseEnvironment) IsDetached() bool {
+	return e.Detached
+}
+
+func (e *BaseEnvironment) ResetOwnership() (err error) {
+	user, err := e.getRunAs()
+	if err != nil || user == nil {
+		return
+	}
+	return user.chown(e.RootDirectory)
+}
+
+func (e *BaseEnvironment) RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	return e.runCommand(ctx, cmd, nil, nil)
+}
+
+//Runs the command the way the main process is run, prepare changes the command before it starts and the group holds it to the limits
+func (e *BaseEnvironment) runCommand(ctx context.Context, cmd *exec.Cmd, prepare func(cmd *exec.Cmd) error, group *cgroup) error {
+	user, err := e.getRunAs()
+	if err != nil {
+		return err
+	}
+	cmd.Env = e.createEnvironment(nil, user)
+	if user != nil {
+		user.apply(cmd)
+	}
+	if prepare != nil {
+		err = prepare(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	setProcessGroup(cmd)
+
+	var gate *cgroupGate
+	if group != nil {
+		gate, err = group.gate(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	err = cmd.Start()
+	if err != nil {
+		if gate != nil {
+			gate.close()
+		}
+		return err
+	}
+	var gateErr error
+	if gate != nil {
+		//the command exits by itself if it cannot be moved into the group
+		gateErr = gate.open(cmd.Process.Pid)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd.Process.Pid, 0)
+		case <-finished:
+		}
+	}()
+	err = cmd.Wait()
+	close(finished)
+	if gateErr != nil {
+		return gateErr
+	}
+	return err
+}
+
 func (e *BaseEnvironment) Delete() (err error) {
 	err = os.RemoveAll(e.RootDirectory)
 	return
 }
 
-func (e *BaseEnvironment) createWrapper() io.Writer {
+//Creates the writer for output of the program, from stdout or stderr
+func (e *BaseEnvironment) createWrapper(source string) io.Writer {
 	if config.GetBoolOrDefault("forward", false) {
-		return io.MultiWriter(os.Stdout, e.ConsoleBuffer, e.WSManager)
+		return io.MultiWriter(os.Stdout, consoleWriter{e, source})
 	}
-	return io.MultiWriter(e.ConsoleBuffer, e.WSManager)
+	return consoleWriter{e, source}
+}
+
+//Reads the user and group the program should run as, defaulting to the node settings
+func (e *BaseEnvironment) configureUser(environmentSection map[string]interface{}) {
+	e.runAsUser = common.GetStringOrDefault(environmentSection, "user", config.GetStringOrDefault("serverUser", ""))
+	e.runAsGroup = common.GetStringOrDefault(environmentSection, "group", config.GetStringOrDefault("serverGroup", ""))
+}
+
+//Reads how long a killed program has to stop before it is forcibly killed, 0 kills it immediately
+func (e *BaseEnvironment) configureKill(environmentSection map[string]interface{}) {
+	timeout := int64(config.GetIntOrDefault("killTimeout", 10))
+	if _, ok := environmentSection["killTimeout"]; ok {
+		value, err := getInt(environmentSection, "killTimeout")
+		if err != nil {
+			logging.Error("Invalid kill timeout", err)
+		} else {
+			timeout = value
+		}
+	}
+	e.killTimeout = time.Duration(timeout) * time.Second
+}
+
+//Gets the user the program runs as, or nil if it runs as the daemon user
+func (e *BaseEnvironment) getRunAs() (*runAs, error) {
+	if e.runAsUser == "" {
+		return nil, nil
+	}
+	return lookupRunAs(e.runAsUser, e.runAsGroup)
+}
+
+//Builds the environment variables for a program.
+//Only allowed variables are taken from the daemon, so none of its secrets are passed on.
+func (e *BaseEnvironment) createEnvironment(env map[string]string, user *runAs) []string {
+	names := append([]string{}, passthroughVariables...)
+	for _, v := range strings.Split(config.GetStringOrDefault("environmentPassthrough", ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			names = append(names, v)
+		}
+	}
+
+	result := make([]string, 0)
+	for _, v := range names {
+		if value, ok := os.LookupEnv(v); ok {
+			result = append(result, v+"="+value)
+		}
+	}
+
+	result = append(result, "HOME="+e.RootDirectory)
+	if user != nil {
+		result = append(result, "USER="+user.name)
+	}
+
+	for k, v := range env {
+		result = append(result, fmt.Sprintf("%s=%s", k, v))
+	}
+	return result
+}
+
+//Variables programs get from the daemon, the windows ones are needed for most programs to start there
+var passthroughVariables = []string{"PATH", "LANG", "LC_ALL", "TZ", "SystemRoot", "SystemDrive", "WINDIR", "COMSPEC", "PATHEXT", "TEMP", "TMP"}
+
+//A user other than the daemon user which programs run as
+type runAs struct {
+	name string
+	uid  int
+	gid  int
 }
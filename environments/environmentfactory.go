@@ -22,7 +22,7 @@ import (
 )
 
 type EnvironmentFactory interface {
-	Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) Environment
+	Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) (Environment, error)
 
 	Key() string
 }
\ No newline at end of file
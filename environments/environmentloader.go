@@ -21,6 +21,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/pufferpanel/apufferi/common"
 	"github.com/pufferpanel/pufferd/cache"
+	"github.com/pufferpanel/pufferd/consolelog"
 	"github.com/pufferpanel/pufferd/utils"
 )
 
@@ -44,9 +45,13 @@ func Create(environmentType, folder, id string, environmentSection map[string]in
 	serverRoot := common.JoinPath(folder, id)
 	rootDirectory := common.GetStringOrDefault(environmentSection, "root", serverRoot)
 	cache := cache.CreateCache()
-	wsManager := utils.CreateWSManager()
+	wsManager := utils.CreateWSManager(id)
 
-	env := factory.Create(folder, id, environmentSection, rootDirectory, cache, wsManager)
+	env, err := factory.Create(folder, id, environmentSection, rootDirectory, cache, wsManager)
+	if err != nil {
+		return nil, err
+	}
+	env.SetConsoleLog(consolelog.Get(folder, id))
 
 	return env, nil
 }
@@ -19,4 +19,5 @@ package environments
 func loadAdditionalModules(mapping map[string]EnvironmentFactory) {
 	mapping["docker"] = DockerFactory{}
 	mapping["tty"] = TtyFactory{}
+	mapping["sandbox"] = SandboxFactory{}
 }
@@ -0,0 +1,60 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrCancelled = errors.New("cancelled")
+
+//Work done in the environment outside of running the program, such as an install.
+//Everything shown on the console while it runs is written to it.
+type Job interface {
+	io.Writer
+
+	//Determines if the job was cancelled, in which case operations should stop as soon as they can
+	Cancelled() bool
+
+	//Reports how much of a download is done, total is -1 if it is not known
+	DownloadProgress(done, total int64)
+}
+
+//Writes to the job of the environment, if it has one
+type jobWriter struct {
+	environment *BaseEnvironment
+}
+
+func (w jobWriter) Write(p []byte) (int, error) {
+	if job := w.environment.GetJob(); job != nil {
+		job.Write(p)
+	}
+	return len(p), nil
+}
+
+func (e *BaseEnvironment) SetJob(job Job) {
+	e.jobLocker.Lock()
+	defer e.jobLocker.Unlock()
+	e.job = job
+}
+
+func (e *BaseEnvironment) GetJob() Job {
+	e.jobLocker.RLock()
+	defer e.jobLocker.RUnlock()
+	return e.job
+}
@@ -0,0 +1,74 @@
+// +build !windows
+
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"github.com/pufferpanel/apufferi/logging"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+//Starts the process in its own process group, so everything it starts can be signalled with it
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	//a session leader already leads its own group
+	if !cmd.SysProcAttr.Setsid {
+		cmd.SysProcAttr.Setpgid = true
+	}
+}
+
+//Sends a signal to every process in the group led by the given process
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+	if err == syscall.ESRCH {
+		//processes from before groups were used are not group leaders
+		err = syscall.Kill(pid, sig)
+	}
+	return err
+}
+
+//Asks every process in the group to stop, then kills whatever is left once the timeout passes
+func killProcessGroup(pid int, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+			if err == syscall.ESRCH {
+				return nil
+			}
+			return err
+		}
+
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			if syscall.Kill(-pid, syscall.Signal(0)) == syscall.ESRCH {
+				return nil
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		logging.Debugf("Process group %d did not stop within %s, killing", pid, timeout)
+	}
+
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	ppError "github.com/pufferpanel/pufferd/errors"
+	"strconv"
+)
+
+//Keys in the environment section which describe resource limits
+var ResourceKeys = []string{"memory", "memorySwap", "cpuQuota", "cpuPeriod", "cpuShares", "cpuset", "pidsLimit", "blkioWeight"}
+
+//Resource limits applied to a server, a value of 0 means no limit
+type ResourceLimits struct {
+	//Memory limit in bytes
+	Memory int64 `json:"memory,omitempty"`
+	//Memory plus swap limit in bytes, -1 allows unlimited swap
+	MemorySwap int64 `json:"memorySwap,omitempty"`
+	//CPU time in microseconds the server may use per period
+	CpuQuota int64 `json:"cpuQuota,omitempty"`
+	//Length of a CPU period in microseconds
+	CpuPeriod int64 `json:"cpuPeriod,omitempty"`
+	//Relative CPU weight against other servers
+	CpuShares int64 `json:"cpuShares,omitempty"`
+	//CPUs the server may run on, such as 0-2 or 0,1
+	Cpuset string `json:"cpuset,omitempty"`
+	//Maximum number of processes
+	PidsLimit int64 `json:"pidsLimit,omitempty"`
+	//Relative block IO weight against other servers, between 10 and 1000
+	BlkioWeight uint16 `json:"blkioWeight,omitempty"`
+}
+
+func ParseResourceLimits(environmentSection map[string]interface{}) (limits ResourceLimits, err error) {
+	defer func() {
+		if err != nil {
+			err = ppError.NewInvalidResourceLimits(err)
+		}
+	}()
+
+	if limits.Memory, err = getBytes(environmentSection, "memory"); err != nil {
+		return
+	}
+	if limits.MemorySwap, err = getBytes(environmentSection, "memorySwap"); err != nil {
+		return
+	}
+	if limits.CpuQuota, err = getInt(environmentSection, "cpuQuota"); err != nil {
+		return
+	}
+	if limits.CpuPeriod, err = getInt(environmentSection, "cpuPeriod"); err != nil {
+		return
+	}
+	if limits.CpuShares, err = getInt(environmentSection, "cpuShares"); err != nil {
+		return
+	}
+	if limits.PidsLimit, err = getInt(environmentSection, "pidsLimit"); err != nil {
+		return
+	}
+
+	weight, err := getInt(environmentSection, "blkioWeight")
+	if err != nil {
+		return
+	}
+	if weight != 0 && (weight < 10 || weight > 1000) {
+		err = fmt.Errorf("blkioWeight must be between 10 and 1000, was %d", weight)
+		return
+	}
+	limits.BlkioWeight = uint16(weight)
+
+	if cpuset, ok := environmentSection["cpuset"]; ok && cpuset != nil {
+		limits.Cpuset = fmt.Sprintf("%v", cpuset)
+	}
+	return
+}
+
+//Reads a whole number, which may be given as a JSON number or a string
+func getInt(section map[string]interface{}, key string) (int64, error) {
+	switch v := section[key].(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return int64(v), nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case string:
+		if v == "" {
+			return 0, nil
+		}
+		result, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value for %s: %s", key, v)
+		}
+		return result, nil
+	default:
+		return 0, fmt.Errorf("invalid value for %s: %v", key, v)
+	}
+}
+
+//Reads a size in bytes, which may be given as a number or a human readable string such as 512m or 2g
+func getBytes(section map[string]interface{}, key string) (int64, error) {
+	v, ok := section[key].(string)
+	if !ok || v == "" || v == "-1" {
+		return getInt(section, key)
+	}
+
+	result, err := units.RAMInBytes(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %s", key, v)
+	}
+	return result, nil
+}
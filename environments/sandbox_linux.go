@@ -0,0 +1,391 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/apufferi/cache"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	ppError "github.com/pufferpanel/pufferd/errors"
+	"github.com/pufferpanel/pufferd/messages"
+	"github.com/pufferpanel/pufferd/utils"
+	"github.com/shirou/gopsutil/process"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//Name the daemon is started under when it is setting up a sandbox for a server
+const sandboxInitName = "pufferd-sandbox"
+
+//System folders bound read-only into every sandbox when they exist on the host
+var sandboxSystemPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/libx32", "/etc", "/opt"}
+
+//Devices made available in the sandbox
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom", "/dev/tty"}
+
+//Runs a server like the standard environment, but in its own mount, PID, UTS and IPC namespaces.
+//Only the system folders and the server's own folder are visible, and only the server's folder is writable.
+//The server has to run as a user other than root.
+type sandbox struct {
+	*standard
+	id       string
+	rootfs   string
+	readOnly []string
+}
+
+func init() {
+	if filepath.Base(os.Args[0]) == sandboxInitName {
+		os.Exit(sandboxInit())
+	}
+}
+
+//Wraps the command so it is started by the daemon in new namespaces, which builds the filesystem before running it
+func (s *sandbox) prepareCommand(cmd *exec.Cmd) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(cmd.Dir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.rootfs, 0755)
+	if err != nil {
+		return err
+	}
+
+	//mounting needs root, so the user is switched to by the sandbox itself once it is built.
+	//There is no user namespace, so a server running as root could undo the sandbox, and is not allowed.
+	uid, gid := -1, -1
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		uid = int(cmd.SysProcAttr.Credential.Uid)
+		gid = int(cmd.SysProcAttr.Credential.Gid)
+	}
+	if uid <= 0 {
+		return errors.New("the sandbox environment needs a user other than root to run the server as")
+	}
+
+	//a program from outside of the sandbox, such as an operation module, is bound in read-only so it can run
+	readOnly := s.readOnly
+	if filepath.IsAbs(cmd.Path) && !isWithin(cmd.Path, append(append([]string{root}, sandboxSystemPaths...), readOnly...)) {
+		readOnly = append(append([]string{}, readOnly...), cmd.Path)
+	}
+
+	args := []string{sandboxInitName, s.rootfs, root, s.id, strconv.Itoa(uid), strconv.Itoa(gid), strconv.Itoa(len(readOnly))}
+	args = append(args, readOnly...)
+	args = append(args, cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+
+	cmd.Path = self
+	cmd.Args = args
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+	}
+	return nil
+}
+
+//Determines if the path is one of the folders or inside of one
+func isWithin(path string, folders []string) bool {
+	for _, folder := range folders {
+		if path == folder || strings.HasPrefix(path, strings.TrimSuffix(folder, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//The daemon only sees the init process of the sandbox, so stats are read from the server it started instead
+func (s *sandbox) GetStats() (*messages.StatMessage, error) {
+	if s.cgroup != nil {
+		return s.standard.GetStats()
+	}
+
+	running, err := s.IsRunning()
+	if err != nil {
+		return nil, err
+	}
+	if !running {
+		return nil, ppError.NewServerOffline()
+	}
+
+	pid := s.mainProcess.Process.Pid
+	if proc, err := process.NewProcess(int32(pid)); err == nil {
+		if children, err := proc.Children(); err == nil && len(children) > 0 {
+			pid = int(children[0].Pid)
+		}
+	}
+	return getProcessStats(pid)
+}
+
+//Entry point of the sandbox init process, which is PID 1 in the new namespaces.
+//Arguments are the rootfs folder, server folder, hostname, uid, gid, the count and list of extra read-only paths, then the command.
+func sandboxInit() int {
+	args := os.Args[1:]
+	if len(args) < 7 {
+		fmt.Fprintln(os.Stderr, "invalid sandbox arguments")
+		return 1
+	}
+
+	rootfs, root, hostname := args[0], args[1], args[2]
+	uid, _ := strconv.Atoi(args[3])
+	gid, _ := strconv.Atoi(args[4])
+	count, _ := strconv.Atoi(args[5])
+	if len(args) < 7+count {
+		fmt.Fprintln(os.Stderr, "invalid sandbox arguments")
+		return 1
+	}
+	readOnly := append(append([]string{}, sandboxSystemPaths...), args[6:6+count]...)
+	command := args[6+count:]
+
+	err := buildSandbox(rootfs, root, readOnly)
+	if err == nil {
+		err = syscall.Sethostname([]byte(hostname))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error creating sandbox: "+err.Error())
+		return 1
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = root
+	cmd.Env = os.Environ()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if uid >= 0 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	}
+
+	signals := make(chan os.Signal, 10)
+	signal.Notify(signals)
+
+	err = cmd.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	//signals sent to the sandbox by the daemon are meant for the server and everything it started
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGCHLD || sig == syscall.SIGURG {
+				continue
+			}
+			signalProcessGroup(cmd.Process.Pid, sig.(syscall.Signal))
+		}
+	}()
+
+	//as PID 1, orphaned processes are reparented here and have to be reaped.
+	//Returning ends the namespace, which kills anything the server left running.
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 1
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+//Builds the new root filesystem and switches to it
+func buildSandbox(rootfs, root string, readOnly []string) (err error) {
+	//keep the mounts below from propagating back to the host
+	if err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return
+	}
+
+	if err = syscall.Mount("tmpfs", rootfs, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(common.JoinPath(rootfs, "proc"), 0755); err != nil {
+		return
+	}
+	if err = syscall.Mount("proc", common.JoinPath(rootfs, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(common.JoinPath(rootfs, "tmp"), 0755); err != nil {
+		return
+	}
+	if err = syscall.Mount("tmpfs", common.JoinPath(rootfs, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return
+	}
+
+	if err = buildDev(rootfs); err != nil {
+		return
+	}
+
+	//bound after the mounts above so they cannot hide paths such as ones under /tmp
+	for _, path := range readOnly {
+		if err = bindReadOnly(rootfs, path); err != nil {
+			return
+		}
+	}
+
+	//bound last so no other mount can hide it, such as when it is under /tmp
+	if err = bindMount(root, common.JoinPath(rootfs, root), true); err != nil {
+		return
+	}
+
+	oldRoot := common.JoinPath(rootfs, ".oldroot")
+	if err = os.MkdirAll(oldRoot, 0700); err != nil {
+		return
+	}
+	if err = syscall.PivotRoot(rootfs, oldRoot); err != nil {
+		return
+	}
+	if err = os.Chdir("/"); err != nil {
+		return
+	}
+	if err = syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return
+	}
+	os.Remove("/.oldroot")
+
+	//nothing outside of the mounts above may be changed
+	return syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+}
+
+func buildDev(rootfs string) (err error) {
+	dev := common.JoinPath(rootfs, "dev")
+	if err = os.MkdirAll(dev, 0755); err != nil {
+		return
+	}
+	//the devices below are bound from the host, no others can be created
+	if err = syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0755"); err != nil {
+		return
+	}
+
+	for _, device := range sandboxDevices {
+		if _, err := os.Stat(device); err != nil {
+			continue
+		}
+		if err = bindMount(device, common.JoinPath(rootfs, device), false); err != nil {
+			return
+		}
+	}
+
+	for link, target := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"} {
+		if err = os.Symlink(target, common.JoinPath(dev, link)); err != nil {
+			return
+		}
+	}
+
+	if err = os.MkdirAll(common.JoinPath(dev, "shm"), 01777); err != nil {
+		return
+	}
+	return syscall.Mount("tmpfs", common.JoinPath(dev, "shm"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+}
+
+//Binds a host path into the sandbox at the same location, keeping symlinks such as /lib -> usr/lib as links
+func bindReadOnly(rootfs, path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	target := common.JoinPath(rootfs, path)
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+
+	if err = bindMount(path, target, info.IsDir()); err != nil {
+		return err
+	}
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID, "")
+}
+
+func bindMount(source, target string, dir bool) error {
+	if dir {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	return syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+}
+
+type SandboxFactory struct {
+	EnvironmentFactory
+}
+
+func (sf SandboxFactory) Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) (Environment, error) {
+	env, err := StandardFactory{}.Create(folder, id, environmentSection, rootDirectory, cache, wsManager)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sandbox{
+		standard: env.(*standard),
+		id:       id,
+		rootfs:   common.JoinPath(folder, ".sandbox", id),
+	}
+	s.Type = "sandbox"
+	s.prepare = s.prepareCommand
+
+	if paths, ok := environmentSection["readOnly"]; ok && paths != nil {
+		for _, v := range common.ToStringArray(paths) {
+			if !filepath.IsAbs(v) {
+				logging.Errorf("Read-only path %s for server %s is not absolute, ignoring", v, id)
+				continue
+			}
+			s.readOnly = append(s.readOnly, v)
+		}
+	}
+	return s, nil
+}
+
+func (sf SandboxFactory) Key() string {
+	return "sandbox"
+}
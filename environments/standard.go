@@ -17,8 +17,11 @@
 package environments
 
 import (
+	"context"
 	"errors"
 	"github.com/pufferpanel/apufferi/cache"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/config"
 	"github.com/pufferpanel/pufferd/utils"
 	"io"
 	"os"
@@ -28,9 +31,9 @@ import (
 	"syscall"
 	"time"
 
-	"fmt"
 	"github.com/pufferpanel/apufferi/logging"
 	ppError "github.com/pufferpanel/pufferd/errors"
+	"github.com/pufferpanel/pufferd/messages"
 	"github.com/shirou/gopsutil/process"
 	"strings"
 )
@@ -39,6 +42,10 @@ type standard struct {
 	*BaseEnvironment
 	mainProcess *exec.Cmd
 	stdInWriter io.Writer
+	detached    *detachedProcess
+	cgroup      *cgroup
+	//Changes the command before it is started, used by environments built on this one
+	prepare func(cmd *exec.Cmd) error
 }
 
 func (s *standard) standardExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error) {
@@ -51,25 +58,71 @@ func (s *standard) standardExecuteAsync(cmd string, args []string, env map[strin
 		return
 	}
 	s.wait.Wait()
+	user, err := s.getRunAs()
+	if err != nil {
+		return
+	}
 	s.mainProcess = exec.Command(cmd, args...)
 	s.mainProcess.Dir = s.RootDirectory
-	s.mainProcess.Env = append(os.Environ(), "HOME="+s.RootDirectory)
-	for k, v := range env {
-		s.mainProcess.Env = append(s.mainProcess.Env, fmt.Sprintf("%s=%s", k, v))
-	}
-	wrapper := s.createWrapper()
-	s.mainProcess.Stdout = wrapper
-	s.mainProcess.Stderr = wrapper
-	pipe, err := s.mainProcess.StdinPipe()
-	if err != nil {
-		logging.Error("Error creating process", err)
+	s.mainProcess.Env = s.createEnvironment(env, user)
+	if user != nil {
+		user.apply(s.mainProcess)
 	}
-	s.stdInWriter = pipe
-	s.wait.Add(1)
+	if s.prepare != nil {
+		err = s.prepare(s.mainProcess)
+		if err != nil {
+			s.mainProcess = nil
+			return
+		}
+	}
+	var gate *cgroupGate
+	if s.cgroup != nil {
+		gate, err = s.cgroup.gate(s.mainProcess)
+		if err != nil {
+			logging.Error("Error applying resource limits", err)
+			s.DisplayToConsole("Failed to apply resource limits\n")
+			s.mainProcess = nil
+			return
+		}
+	}
+	wrapper := s.createWrapper(messages.SourceStdout)
 	logging.Debugf("Starting process: %s %s", s.mainProcess.Path, strings.Join(s.mainProcess.Args, " "))
-	err = s.mainProcess.Start()
+	if s.Detached {
+		var stdin io.WriteCloser
+		stdin, err = s.detached.start(s.mainProcess, wrapper)
+		if err != nil {
+			if gate != nil {
+				gate.close()
+			}
+			logging.Error("Error starting process", err)
+			return
+		}
+		s.stdInWriter = stdin
+		s.wait.Add(1)
+	} else {
+		setProcessGroup(s.mainProcess)
+		s.mainProcess.Stdout = wrapper
+		s.mainProcess.Stderr = s.createWrapper(messages.SourceStderr)
+		var pipe io.WriteCloser
+		pipe, err = s.mainProcess.StdinPipe()
+		if err != nil {
+			logging.Error("Error creating process", err)
+		}
+		s.stdInWriter = pipe
+		s.wait.Add(1)
+		err = s.mainProcess.Start()
+	}
+	if gate != nil {
+		s.openGate(gate, err == nil)
+	}
 	go func() {
 		err := s.mainProcess.Wait()
+		if s.Detached {
+			s.stopDetached()
+		}
+		if s.cgroup != nil {
+			s.cgroup.destroy()
+		}
 		s.wait.Done()
 		if callback != nil {
 			if s.mainProcess == nil || s.mainProcess.ProcessState == nil || err != nil  {
@@ -87,6 +140,70 @@ func (s *standard) standardExecuteAsync(cmd string, args []string, env map[strin
 	return
 }
 
+func (s *standard) Reattach(callback func(graceful bool)) (attached bool, err error) {
+	if !s.Detached {
+		return
+	}
+
+	proc := s.detached.find()
+	if proc == nil {
+		return
+	}
+
+	stdin, err := s.detached.reattach(s.createWrapper(messages.SourceStdout))
+	if err != nil {
+		return
+	}
+
+	logging.Debugf("Reattached to process (%d)", proc.Pid)
+	s.mainProcess = &exec.Cmd{Process: proc}
+	s.stdInWriter = stdin
+	s.wait.Add(1)
+
+	go func() {
+		waitForDetached(proc)
+		s.stopDetached()
+		if s.cgroup != nil {
+			s.cgroup.destroy()
+		}
+		s.wait.Done()
+		//the exit status of a process the daemon did not start cannot be read
+		if callback != nil {
+			callback(true)
+		}
+	}()
+	return true, nil
+}
+
+func (s *standard) RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	err := s.runCommand(ctx, cmd, s.prepare, s.cgroup)
+	//the group is left to the main process while it runs
+	if running, _ := s.IsRunning(); !running && s.cgroup != nil {
+		s.cgroup.destroy()
+	}
+	return err
+}
+
+//Moves the process into the cgroup of the server and lets it run, or releases the gate if it did not start
+func (s *standard) openGate(gate *cgroupGate, started bool) {
+	if !started {
+		gate.close()
+		return
+	}
+	err := gate.open(s.mainProcess.Process.Pid)
+	if err != nil {
+		logging.Error("Error applying resource limits", err)
+		s.DisplayToConsole("Failed to apply resource limits\n")
+	}
+}
+
+func (s *standard) stopDetached() {
+	if closer, ok := s.stdInWriter.(io.Closer); ok {
+		closer.Close()
+	}
+	s.detached.stop()
+}
+
 func (s *standard) ExecuteInMainProcess(cmd string) (err error) {
 	running, err := s.IsRunning()
 	if err != nil {
@@ -109,7 +226,7 @@ func (s *standard) Kill() (err error) {
 	if !running {
 		return
 	}
-	err = s.mainProcess.Process.Kill()
+	err = killProcessGroup(s.mainProcess.Process.Pid, s.killTimeout)
 	s.mainProcess.Process.Release()
 	s.mainProcess = nil
 	return
@@ -128,7 +245,7 @@ func (s *standard) IsRunning() (isRunning bool, err error) {
 	return
 }
 
-func (s *standard) GetStats() (map[string]interface{}, error) {
+func (s *standard) GetStats() (*messages.StatMessage, error) {
 	running, err := s.IsRunning()
 	if err != nil {
 		return nil, err
@@ -136,20 +253,55 @@ func (s *standard) GetStats() (map[string]interface{}, error) {
 	if !running {
 		return nil, ppError.NewServerOffline()
 	}
-	process, err := process.NewProcess(int32(s.mainProcess.Process.Pid))
+	if s.cgroup != nil {
+		stats, err := s.cgroup.stats()
+		if err == nil {
+			return stats, nil
+		}
+		logging.Error("Error reading cgroup stats", err)
+	}
+	return getProcessStats(s.mainProcess.Process.Pid)
+}
+
+func (s *standard) SetResourceLimits(limits ResourceLimits) error {
+	if s.cgroup == nil {
+		return s.BaseEnvironment.SetResourceLimits(limits)
+	}
+	return s.cgroup.setLimits(limits)
+}
+
+//Samples the given process, used by the native environments
+//Network usage cannot be attributed to a single process, so it is left empty
+func getProcessStats(pid int) (*messages.StatMessage, error) {
+	proc, err := process.NewProcess(int32(pid))
 	if err != nil {
 		return nil, err
 	}
-	resultMap := make(map[string]interface{})
-	memMap, _ := process.MemoryInfo()
-	resultMap["memory"] = memMap.RSS
-	cpu, _ := process.Percent(time.Millisecond * 50)
-	resultMap["cpu"] = cpu
-	return resultMap, nil
+
+	stats := &messages.StatMessage{}
+
+	memInfo, err := proc.MemoryInfo()
+	if err == nil && memInfo != nil {
+		stats.Memory = float64(memInfo.RSS)
+	}
+
+	stats.Cpu, _ = proc.Percent(time.Millisecond * 50)
+
+	ioInfo, err := proc.IOCounters()
+	if err == nil && ioInfo != nil {
+		stats.DiskRead = float64(ioInfo.ReadBytes)
+		stats.DiskWrite = float64(ioInfo.WriteBytes)
+	}
+
+	return stats, nil
 }
 
 func (e *standard) Create() error {
-	return os.Mkdir(e.RootDirectory, 0755)
+	err := os.Mkdir(e.RootDirectory, 0755)
+	if err != nil {
+		return err
+	}
+	return e.ResetOwnership()
 }
 
 func (e *standard) WaitForMainProcess() error {
@@ -182,14 +334,14 @@ func (e *standard) SendCode(code int) error {
 		return err
 	}
 
-	return e.mainProcess.Process.Signal(syscall.Signal(code))
+	return signalProcessGroup(e.mainProcess.Process.Pid, syscall.Signal(code))
 }
 
 type StandardFactory struct {
 	EnvironmentFactory
 }
 
-func (sf StandardFactory) Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) Environment {
+func (sf StandardFactory) Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) (Environment, error) {
 	s := &standard{BaseEnvironment: &BaseEnvironment{Type: "standard"}}
 	s.BaseEnvironment.executeAsync = s.standardExecuteAsync
 	s.BaseEnvironment.waitForMainProcess = s.WaitForMainProcess
@@ -198,7 +350,17 @@ func (sf StandardFactory) Create(folder, id string, environmentSection map[strin
 	s.RootDirectory = rootDirectory
 	s.ConsoleBuffer = cache
 	s.WSManager = wsManager
-	return s
+	s.configureUser(environmentSection)
+	s.configureKill(environmentSection)
+	s.Detached = common.GetBooleanOrDefault(environmentSection, "detached", config.GetBoolOrDefault("detachProcesses", false))
+	s.detached = newDetachedProcess(common.JoinPath(folder, ".detached", id))
+
+	limits, err := ParseResourceLimits(environmentSection)
+	if err != nil {
+		return nil, err
+	}
+	s.cgroup = newCgroup(id, limits)
+	return s, nil
 }
 
 func (sf StandardFactory) Key() string {
@@ -0,0 +1,85 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"github.com/pufferpanel/pufferd/utils"
+)
+
+//how much of the output is sent to a terminal when it connects, so it has something to show
+const terminalScrollback = 64 * 1024
+
+//Environments which run their program in a terminal, which clients can use directly rather than a line at a time.
+//Output is sent to terminals as it is, and input is written to the program as it is, so interactive programs work.
+type Terminal interface {
+	AddTerminal(conn *utils.Connection)
+
+	RemoveTerminal(conn *utils.Connection)
+
+	//Writes input to the terminal as it is, such as keystrokes
+	WriteTerminal(data []byte) error
+
+	ResizeTerminal(cols, rows uint16) error
+}
+
+func (e *BaseEnvironment) AddTerminal(conn *utils.Connection) {
+	e.terminalLocker.Lock()
+	defer e.terminalLocker.Unlock()
+	if len(e.terminalOutput) > 0 {
+		conn.SendBinary(append([]byte{}, e.terminalOutput...))
+	}
+	e.terminals = append(e.terminals, conn)
+}
+
+func (e *BaseEnvironment) RemoveTerminal(conn *utils.Connection) {
+	e.terminalLocker.Lock()
+	defer e.terminalLocker.Unlock()
+	for i, v := range e.terminals {
+		if v == conn {
+			e.terminals = append(e.terminals[:i], e.terminals[i+1:]...)
+			return
+		}
+	}
+}
+
+//Sends the output of the program to every terminal
+type terminalWriter struct {
+	environment *BaseEnvironment
+}
+
+func (w terminalWriter) Write(p []byte) (int, error) {
+	e := w.environment
+	e.terminalLocker.Lock()
+	defer e.terminalLocker.Unlock()
+
+	e.terminalOutput = append(e.terminalOutput, p...)
+	if len(e.terminalOutput) > terminalScrollback {
+		e.terminalOutput = append([]byte{}, e.terminalOutput[len(e.terminalOutput)-terminalScrollback:]...)
+	}
+
+	terminals := e.terminals[:0]
+	for _, conn := range e.terminals {
+		if conn.SendBinary(append([]byte{}, p...)) != utils.ErrClosed && !conn.IsClosed() {
+			terminals = append(terminals, conn)
+		}
+	}
+	for i := len(terminals); i < len(e.terminals); i++ {
+		e.terminals[i] = nil
+	}
+	e.terminals = terminals
+	return len(p), nil
+}
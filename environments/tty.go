@@ -19,14 +19,15 @@
 package environments
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"github.com/kr/pty"
 	"github.com/pufferpanel/apufferi/cache"
+	"github.com/pufferpanel/apufferi/common"
 	"github.com/pufferpanel/apufferi/logging"
 	ppError "github.com/pufferpanel/pufferd/errors"
+	"github.com/pufferpanel/pufferd/messages"
 	"github.com/pufferpanel/pufferd/utils"
-	"github.com/shirou/gopsutil/process"
 	"io"
 	"os"
 	"os/exec"
@@ -41,6 +42,8 @@ type tty struct {
 	*BaseEnvironment
 	mainProcess *exec.Cmd
 	stdInWriter io.Writer
+	pty         *os.File
+	cgroup      *cgroup
 }
 
 func (s *tty) ttyExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error) {
@@ -54,23 +57,50 @@ func (s *tty) ttyExecuteAsync(cmd string, args []string, env map[string]string,
 	}
 	s.wait.Wait()
 
+	user, err := s.getRunAs()
+	if err != nil {
+		return
+	}
+
 	process := exec.Command(cmd, args...)
 	process.Dir = s.RootDirectory
-	process.Env = append(os.Environ(), "HOME="+s.RootDirectory)
-	for k, v := range env {
-		s.mainProcess.Env = append(s.mainProcess.Env, fmt.Sprintf("%s=%s", k, v))
-	}
+	process.Env = s.createEnvironment(env, user)
 
-	wrapper := s.createWrapper()
+	wrapper := io.MultiWriter(s.createWrapper(messages.SourceStdout), terminalWriter{s.BaseEnvironment})
 	s.wait.Add(1)
 	process.SysProcAttr = &syscall.SysProcAttr{Setctty: true, Setsid: true}
+	if user != nil {
+		user.apply(process)
+	}
+	var gate *cgroupGate
+	if s.cgroup != nil {
+		gate, err = s.cgroup.gate(process)
+		if err != nil {
+			s.wait.Done()
+			logging.Error("Error applying resource limits", err)
+			s.DisplayToConsole("Failed to apply resource limits\n")
+			return
+		}
+	}
 	s.mainProcess = process
 	logging.Debug("Starting process: %s %s", s.mainProcess.Path, strings.Join(s.mainProcess.Args, " "))
 	tty, err := pty.Start(process)
 	s.stdInWriter = tty
+	s.pty = tty
+	if gate != nil {
+		if err != nil {
+			gate.close()
+		} else if gErr := gate.open(process.Process.Pid); gErr != nil {
+			logging.Error("Error applying resource limits", gErr)
+			s.DisplayToConsole("Failed to apply resource limits\n")
+		}
+	}
 	go func() {
 		io.Copy(wrapper, tty)
 		err = process.Wait()
+		if s.cgroup != nil {
+			s.cgroup.destroy()
+		}
 		s.wait.Done()
 		if callback != nil {
 			if s.mainProcess == nil || s.mainProcess.ProcessState == nil || err != nil  {
@@ -86,6 +116,15 @@ func (s *tty) ttyExecuteAsync(cmd string, args []string, env map[string]string,
 	return
 }
 
+func (s *tty) RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	err := s.runCommand(ctx, cmd, nil, s.cgroup)
+	//the group is left to the main process while it runs
+	if running, _ := s.IsRunning(); !running && s.cgroup != nil {
+		s.cgroup.destroy()
+	}
+	return err
+}
+
 func (s *tty) ExecuteInMainProcess(cmd string) (err error) {
 	running, err := s.IsRunning()
 	if err != nil {
@@ -100,6 +139,31 @@ func (s *tty) ExecuteInMainProcess(cmd string) (err error) {
 	return
 }
 
+func (s *tty) WriteTerminal(data []byte) (err error) {
+	running, err := s.IsRunning()
+	if err != nil {
+		return err
+	}
+	if !running {
+		err = errors.New("main process has not been started")
+		return
+	}
+	_, err = s.stdInWriter.Write(data)
+	return
+}
+
+func (s *tty) ResizeTerminal(cols, rows uint16) (err error) {
+	running, err := s.IsRunning()
+	if err != nil {
+		return err
+	}
+	if !running {
+		err = errors.New("main process has not been started")
+		return
+	}
+	return pty.Setsize(s.pty, &pty.Winsize{Cols: cols, Rows: rows})
+}
+
 func (s *tty) Kill() (err error) {
 	running, err := s.IsRunning()
 	if err != nil {
@@ -108,7 +172,7 @@ func (s *tty) Kill() (err error) {
 	if !running {
 		return
 	}
-	err = s.mainProcess.Process.Kill()
+	err = killProcessGroup(s.mainProcess.Process.Pid, s.killTimeout)
 	s.mainProcess.Process.Release()
 	s.mainProcess = nil
 	return
@@ -127,7 +191,7 @@ func (s *tty) IsRunning() (isRunning bool, err error) {
 	return
 }
 
-func (s *tty) GetStats() (map[string]interface{}, error) {
+func (s *tty) GetStats() (*messages.StatMessage, error) {
 	running, err := s.IsRunning()
 	if err != nil {
 		return nil, err
@@ -135,20 +199,29 @@ func (s *tty) GetStats() (map[string]interface{}, error) {
 	if !running {
 		return nil, ppError.NewServerOffline()
 	}
-	process, err := process.NewProcess(int32(s.mainProcess.Process.Pid))
-	if err != nil {
-		return nil, err
+	if s.cgroup != nil {
+		stats, err := s.cgroup.stats()
+		if err == nil {
+			return stats, nil
+		}
+		logging.Error("Error reading cgroup stats", err)
 	}
-	resultMap := make(map[string]interface{})
-	memMap, _ := process.MemoryInfo()
-	resultMap["memory"] = memMap.RSS
-	cpu, _ := process.Percent(time.Millisecond * 50)
-	resultMap["cpu"] = cpu
-	return resultMap, nil
+	return getProcessStats(s.mainProcess.Process.Pid)
+}
+
+func (s *tty) SetResourceLimits(limits ResourceLimits) error {
+	if s.cgroup == nil {
+		return s.BaseEnvironment.SetResourceLimits(limits)
+	}
+	return s.cgroup.setLimits(limits)
 }
 
 func (e *tty) Create() error {
-	return os.Mkdir(e.RootDirectory, 0755)
+	err := os.Mkdir(e.RootDirectory, 0755)
+	if err != nil {
+		return err
+	}
+	return e.ResetOwnership()
 }
 
 func (e *tty) WaitForMainProcess() error {
@@ -181,14 +254,14 @@ func (e *tty) SendCode(code int) error {
 		return err
 	}
 
-	return e.mainProcess.Process.Signal(syscall.Signal(code))
+	return signalProcessGroup(e.mainProcess.Process.Pid, syscall.Signal(code))
 }
 
 type TtyFactory struct {
 	EnvironmentFactory
 }
 
-func (tf TtyFactory) Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) Environment {
+func (tf TtyFactory) Create(folder, id string, environmentSection map[string]interface{}, rootDirectory string, cache cache.Cache, wsManager utils.WebSocketManager) (Environment, error) {
 	t := &tty{BaseEnvironment: &BaseEnvironment{Type: "tty"}}
 	t.BaseEnvironment.executeAsync = t.ttyExecuteAsync
 	t.BaseEnvironment.waitForMainProcess = t.WaitForMainProcess
@@ -197,7 +270,20 @@ func (tf TtyFactory) Create(folder, id string, environmentSection map[string]int
 	t.RootDirectory = rootDirectory
 	t.ConsoleBuffer = cache
 	t.WSManager = wsManager
-	return t
+	t.configureUser(environmentSection)
+	t.configureKill(environmentSection)
+
+	limits, err := ParseResourceLimits(environmentSection)
+	if err != nil {
+		return nil, err
+	}
+	t.cgroup = newCgroup(id, limits)
+
+	//the pty is owned by the daemon, so the process cannot outlive it
+	if common.GetBooleanOrDefault(environmentSection, "detached", false) {
+		logging.Warn("Server " + id + " uses the tty environment, which cannot run detached")
+	}
+	return t, nil
 }
 
 func (tf TtyFactory) Key() string {
@@ -0,0 +1,80 @@
+// +build !windows
+
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+//Looks up the user and group, given as names or numeric ids.
+//If no group is given, the primary group of the user is used.
+func lookupRunAs(userName, groupName string) (*runAs, error) {
+	u, err := user.Lookup(userName)
+	if _, ok := err.(user.UnknownUserError); ok {
+		u, err = user.LookupId(userName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		gid = g.Gid
+	}
+
+	result := &runAs{name: u.Username}
+	result.uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	result.gid, err = strconv.Atoi(gid)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *runAs) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(r.uid), Gid: uint32(r.gid)}
+}
+
+func (r *runAs) chown(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		//symlinks are changed themselves, never what they point to
+		return os.Lchown(path, r.uid, r.gid)
+	})
+}
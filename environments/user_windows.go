@@ -0,0 +1,33 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package environments
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func lookupRunAs(userName, groupName string) (*runAs, error) {
+	return nil, errors.New("running servers as another user is not supported on windows")
+}
+
+func (r *runAs) apply(cmd *exec.Cmd) {
+}
+
+func (r *runAs) chown(root string) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package errors
+
+//Resource limits which could not be parsed, or are out of range
+type InvalidResourceLimits struct {
+	reason error
+}
+
+func (e InvalidResourceLimits) Error() string {
+	return "Invalid resource limits: " + e.reason.Error()
+}
+
+func NewInvalidResourceLimits(reason error) error {
+	return InvalidResourceLimits{reason: reason}
+}
@@ -16,8 +16,36 @@
 
 package messages
 
+const (
+	SourceStdout  = "stdout"
+	SourceStderr  = "stderr"
+	SourceDaemon  = "daemon"
+	SourceInstall = "install"
+)
+
 type ConsoleMessage struct {
-	Logs []string `json:"logs"`
+	Logs  []string      `json:"logs"`
+	Lines []ConsoleLine `json:"lines,omitempty"`
+	//Set when a client carrying on from a line has missed lines which are no longer kept
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+//A line of console output. Sequences go up by one for each line of a server, so clients can tell which they have seen.
+//Partial lines are output which has not ended with a newline yet, and are continued by the next line.
+type ConsoleLine struct {
+	Sequence int64  `json:"sequence"`
+	Time     int64  `json:"time"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+	Partial  bool   `json:"partial,omitempty"`
+}
+
+//Gets the line as it is written to the console
+func (l ConsoleLine) Text() string {
+	if l.Partial {
+		return l.Message
+	}
+	return l.Message + "\n"
 }
 
 func (m ConsoleMessage) Key() string {
@@ -0,0 +1,37 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package messages
+
+type JobMessage struct {
+	Id     string `json:"id"`
+	Type   string `json:"type"`
+	Server string `json:"server"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	//Operation being run, starting from 1, out of the number of operations
+	Operation  int   `json:"operation"`
+	Operations int   `json:"operations"`
+	Downloaded int64 `json:"downloaded,omitempty"`
+	//Size of the current download, -1 if it is not known
+	DownloadSize int64 `json:"downloadSize,omitempty"`
+	Started      int64 `json:"started"`
+	Finished     int64 `json:"finished,omitempty"`
+}
+
+func (m JobMessage) Key() string {
+	return "job"
+}
@@ -23,4 +23,8 @@ type Message interface {
 type Transmission struct {
 	Message Message `json:"data"`
 	Type string `json:"type"`
+	//The server the message is about, as one socket can listen to several servers
+	Server string `json:"server,omitempty"`
+	//The request this answers, as given by the client
+	Request string `json:"request,omitempty"`
 }
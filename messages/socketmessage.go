@@ -0,0 +1,43 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package messages
+
+//Sent when a socket using version 2 of the protocol opens
+type HelloMessage struct {
+	Version int `json:"version"`
+}
+
+func (m HelloMessage) Key() string {
+	return "hello"
+}
+
+//The answer to a request on a socket
+type ResultMessage struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (m ResultMessage) Key() string {
+	return "result"
+}
+
+type PongMessage struct {
+}
+
+func (m PongMessage) Key() string {
+	return "pong"
+}
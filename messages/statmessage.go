@@ -17,8 +17,12 @@
 package messages
 
 type StatMessage struct {
-	Memory float64 `json:"memory"`
-	Cpu    float64 `json:"cpu"`
+	Memory    float64 `json:"memory"`
+	Cpu       float64 `json:"cpu"`
+	NetworkRx float64 `json:"networkRx"`
+	NetworkTx float64 `json:"networkTx"`
+	DiskRead  float64 `json:"diskRead"`
+	DiskWrite float64 `json:"diskWrite"`
 }
 
 func (m StatMessage) Key() string {
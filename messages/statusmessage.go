@@ -1,5 +1,5 @@
 /*
- Copyright 2018 Padduck, LLC
+ Copyright 2019 Padduck, LLC
 
  Licensed under the Apache License, Version 2.0 (the "License");
  you may not use this file except in compliance with the License.
@@ -14,7 +14,13 @@
  limitations under the License.
 */
 
-package operations
+package messages
 
-func loadOpModules() {
+type StatusMessage struct {
+	Status   string `json:"status"`
+	Previous string `json:"previous"`
+}
+
+func (m StatusMessage) Key() string {
+	return "status"
 }
@@ -0,0 +1,348 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/messages"
+	"github.com/pufferpanel/pufferd/programs/operations"
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobInstall   = "install"
+	JobUninstall = "uninstall"
+)
+
+const (
+	JobRunning   = "running"
+	JobSuccess   = "success"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+var ErrJobRunning = errors.New("a job is already running for the server")
+var ErrNoJob = errors.New("no job with given id")
+var ErrJobNotRunning = errors.New("job is not running")
+
+//An install or uninstall of a server, run in the background.
+//Everything shown on the console while it runs is kept in its log.
+type Job struct {
+	status       messages.JobMessage
+	err          error
+	cancelled    bool
+	log          *os.File
+	environment  environments.Environment
+	lastProgress time.Time
+	done         chan struct{}
+	locker       sync.Mutex
+}
+
+//Gets the folder the logs and results of the jobs of a server are kept in
+func getJobFolder(serverId string) string {
+	return common.JoinPath(ServerFolder, ".jobs", serverId)
+}
+
+func newJob(serverId, jobType string, environment environments.Environment) (*Job, error) {
+	job := &Job{
+		status: messages.JobMessage{
+			Id:      uuid.NewV4().String(),
+			Type:    jobType,
+			Server:  serverId,
+			Status:  JobRunning,
+			Started: time.Now().Unix(),
+		},
+		environment: environment,
+		done:        make(chan struct{}),
+	}
+
+	folder := getJobFolder(serverId)
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, err
+	}
+	job.log, err = os.Create(common.JoinPath(folder, job.status.Id+".log"))
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (j *Job) Write(p []byte) (int, error) {
+	j.locker.Lock()
+	defer j.locker.Unlock()
+	if j.log == nil {
+		return len(p), nil
+	}
+	return j.log.Write(p)
+}
+
+func (j *Job) Cancelled() bool {
+	j.locker.Lock()
+	defer j.locker.Unlock()
+	return j.cancelled
+}
+
+func (j *Job) DownloadProgress(done, total int64) {
+	j.locker.Lock()
+	j.status.Downloaded = done
+	j.status.DownloadSize = total
+	//downloads report every read, so the progress is only sent out every so often
+	send := done == total || time.Since(j.lastProgress) >= time.Second
+	if send {
+		j.lastProgress = time.Now()
+	}
+	status := j.status
+	j.locker.Unlock()
+
+	if send {
+		j.environment.BroadcastMessage(status)
+	}
+}
+
+func (j *Job) startOperation(index, total int) {
+	j.locker.Lock()
+	j.status.Operation = index
+	j.status.Operations = total
+	j.status.Downloaded = 0
+	j.status.DownloadSize = 0
+	status := j.status
+	j.locker.Unlock()
+
+	j.environment.BroadcastMessage(status)
+}
+
+//Stops the job, killing anything it is running
+func (j *Job) Cancel() error {
+	j.locker.Lock()
+	running := j.status.Status == JobRunning
+	if running {
+		j.cancelled = true
+	}
+	j.locker.Unlock()
+
+	if !running {
+		return ErrJobNotRunning
+	}
+
+	logging.Debugf("Cancelling %s job %s of server %s", j.status.Type, j.status.Id, j.status.Server)
+	j.environment.DisplayToConsole("Cancelling %s\n", j.status.Type)
+	//the server is stopped while a job runs, so anything running is part of the job.
+	//Operations which are not processes stop at their next check, so the job is cancelled either way.
+	if running, _ := j.environment.IsRunning(); !running {
+		return nil
+	}
+	if err := j.environment.Kill(); err != nil {
+		logging.Error("Error killing process of cancelled job", err)
+	}
+	return nil
+}
+
+func (j *Job) finish(err error) {
+	j.locker.Lock()
+	if j.cancelled {
+		err = environments.ErrCancelled
+	}
+	j.err = err
+	j.status.Finished = time.Now().Unix()
+	switch {
+	case err == environments.ErrCancelled:
+		j.status.Status = JobCancelled
+	case err != nil:
+		j.status.Status = JobFailed
+		j.status.Error = err.Error()
+	default:
+		j.status.Status = JobSuccess
+	}
+	status := j.status
+
+	if j.log != nil {
+		if status.Error != "" {
+			fmt.Fprintf(j.log, "Finished %s: %s (%s)\n", status.Type, status.Status, status.Error)
+		} else {
+			fmt.Fprintf(j.log, "Finished %s: %s\n", status.Type, status.Status)
+		}
+		j.log.Close()
+		j.log = nil
+	}
+	j.locker.Unlock()
+
+	data, jErr := json.MarshalIndent(status, "", "  ")
+	if jErr == nil {
+		jErr = ioutil.WriteFile(common.JoinPath(getJobFolder(status.Server), status.Id+".json"), data, 0644)
+	}
+	if jErr != nil {
+		logging.Error("Error saving result of job "+status.Id, jErr)
+	}
+
+	j.environment.BroadcastMessage(status)
+	close(j.done)
+}
+
+func (j *Job) GetStatus() messages.JobMessage {
+	j.locker.Lock()
+	defer j.locker.Unlock()
+	return j.status
+}
+
+//Waits for the job to finish, returning why it failed
+func (j *Job) Wait() error {
+	<-j.done
+	j.locker.Lock()
+	defer j.locker.Unlock()
+	return j.err
+}
+
+//Runs the work as a job of the program, unless it already has one running
+func (p *ProgramData) startJob(jobType string, work func(job *Job) error) (*Job, error) {
+	p.jobLocker.Lock()
+	defer p.jobLocker.Unlock()
+
+	if p.job != nil && p.job.GetStatus().Status == JobRunning {
+		return nil, ErrJobRunning
+	}
+
+	job, err := newJob(p.Id(), jobType, p.Environment)
+	if err != nil {
+		return nil, err
+	}
+	p.job = job
+	p.Environment.SetJob(job)
+	p.Environment.BroadcastMessage(job.GetStatus())
+
+	go func() {
+		err := work(job)
+		p.Environment.SetJob(nil)
+		job.finish(err)
+	}()
+	return job, nil
+}
+
+//Runs the operations, reporting which one is running to the job
+func (p *ProgramData) runJobOperations(job *Job, process operations.OperationProcess) (err error) {
+	total := process.Remaining()
+	for i := 1; process.HasNext(); i++ {
+		if job.Cancelled() {
+			return environments.ErrCancelled
+		}
+		job.startOperation(i, total)
+		err = process.RunNext(p.Environment)
+		if err != nil {
+			if err != environments.ErrCancelled {
+				logging.Error("Error running process: ", err)
+			}
+			return
+		}
+	}
+	return
+}
+
+func (p *ProgramData) GetJobs() ([]messages.JobMessage, error) {
+	result := make([]messages.JobMessage, 0)
+
+	p.jobLocker.Lock()
+	current := p.job
+	p.jobLocker.Unlock()
+	if current != nil && current.GetStatus().Status == JobRunning {
+		result = append(result, current.GetStatus())
+	}
+
+	files, err := ioutil.ReadDir(getJobFolder(p.Id()))
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		status, err := readJob(p.Id(), strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			logging.Error("Error reading job "+file.Name(), err)
+			continue
+		}
+		result = append(result, status)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started > result[j].Started
+	})
+	return result, nil
+}
+
+func (p *ProgramData) GetJob(id string) (messages.JobMessage, error) {
+	p.jobLocker.Lock()
+	current := p.job
+	p.jobLocker.Unlock()
+	if current != nil && current.GetStatus().Id == id {
+		return current.GetStatus(), nil
+	}
+	return readJob(p.Id(), id)
+}
+
+//Gets the path to the log of the job
+func (p *ProgramData) GetJobLog(id string) (string, error) {
+	if _, err := p.GetJob(id); err != nil {
+		return "", err
+	}
+	return common.JoinPath(getJobFolder(p.Id()), id+".log"), nil
+}
+
+func (p *ProgramData) CancelJob(id string) error {
+	p.jobLocker.Lock()
+	current := p.job
+	p.jobLocker.Unlock()
+	if current == nil || current.GetStatus().Id != id {
+		if _, err := readJob(p.Id(), id); err != nil {
+			return err
+		}
+		return ErrJobNotRunning
+	}
+	return current.Cancel()
+}
+
+func readJob(serverId, id string) (status messages.JobMessage, err error) {
+	//ids are used as file names, so they cannot be allowed to point elsewhere
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		err = ErrNoJob
+		return
+	}
+
+	data, err := ioutil.ReadFile(common.JoinPath(getJobFolder(serverId), id+".json"))
+	if os.IsNotExist(err) {
+		err = ErrNoJob
+		return
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &status)
+	return
+}
@@ -56,7 +56,7 @@ func LoadFromFolder() {
 	}
 	var program Program
 	for _, element := range programFiles {
-		if element.IsDir() {
+		if element.IsDir() || filepath.Ext(element.Name()) != ".json" {
 			continue
 		}
 		id := strings.TrimSuffix(element.Name(), filepath.Ext(element.Name()))
@@ -67,6 +67,12 @@ func LoadFromFolder() {
 		}
 		logging.Infof("Loaded server %s", program.Id())
 		allPrograms = append(allPrograms, program)
+		program.StartScheduler()
+
+		_, err = program.Reattach()
+		if err != nil {
+			logging.Error(fmt.Sprintf("Error reattaching to server %s", program.Id()), err)
+		}
 	}
 }
 
@@ -108,6 +114,7 @@ func LoadFromData(id string, source []byte) (program Program, err error) {
 	if err != nil {
 		return
 	}
+	data.ProgramData.Environment.SetDownloadListener(data.ProgramData.onDownload)
 	program = &data.ProgramData
 	return
 }
@@ -159,6 +166,8 @@ func Create(id string, serverType string, data map[string]interface{}, env map[s
 	}
 
 	program := templateJson.Create(env)
+	//written the way servers are saved, so it is read back the same way when it is loaded
+	server := ServerJson{ProgramData: *program.(*ProgramData)}
 
 	f, err := os.Create(common.JoinPath(ServerFolder, id+".json"))
 
@@ -172,22 +181,31 @@ func Create(id string, serverType string, data map[string]interface{}, env map[s
 	encoder := json.NewEncoder(f)
 	encoder.SetEscapeHTML(false)
 	encoder.SetIndent("", "  ")
-	err = encoder.Encode(program)
+	err = encoder.Encode(server)
 
 	if err != nil {
 		logging.Error("Error writing server file", err)
 		return false
 	}
 
-	newData, err := json.Marshal(program)
+	newData, err := json.Marshal(server)
 
 	if err != nil {
 		logging.Error("Error regenerating file", err)
 		return false
 	}
 
-	program, _ = LoadFromData(id, newData)
+	program, err = LoadFromData(id, newData)
+	if err != nil {
+		logging.Error("Error loading server "+id, err)
+		f.Close()
+		if err = os.Remove(common.JoinPath(ServerFolder, id+".json")); err != nil {
+			logging.Error("Error removing server file", err)
+		}
+		return false
+	}
 	allPrograms = append(allPrograms, program)
+	program.StartScheduler()
 	err = program.Create()
 	return err == nil
 }
@@ -212,12 +230,14 @@ func Delete(id string) (err error) {
 	}
 
 	if running {
-		err = program.Stop()
+		_, err = program.StopAndWait()
 		if err != nil {
 			return
 		}
 	}
 
+	program.StopScheduler()
+
 	err = program.Destroy()
 	if err != nil {
 		return
@@ -268,6 +288,7 @@ func Reload(id string) (err error) {
 	newV2 := newVersion.(*ProgramData)
 
 	program.CopyFrom(newV2)
+	program.StartScheduler()
 	return
 }
 
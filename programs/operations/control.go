@@ -0,0 +1,367 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/programs/operations/ops"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+//Operations which run other operations. These are built into the process rather than being factories,
+//as their blocks are only generated when they run.
+var controlMapping = map[string]func(mapping map[string]interface{}, data map[string]interface{}, env map[string]string) (ops.Operation, error){
+	"if":      createIf,
+	"foreach": createForeach,
+	"try":     createTry,
+}
+
+//Marks an operation whose failure does not stop the process
+type continueOnErrorOperation struct {
+	ops.Operation
+}
+
+//A list of operations, generated and run with the data it is given
+type block struct {
+	operations []map[string]interface{}
+	env        map[string]string
+}
+
+func (b block) run(environment environments.Environment, data map[string]interface{}) error {
+	if len(b.operations) == 0 {
+		return nil
+	}
+	process, err := GenerateProcess(b.operations, environment, data, b.env)
+	if err != nil {
+		return err
+	}
+	return process.Run(environment)
+}
+
+func getBlock(mapping map[string]interface{}, key string, env map[string]string) (block, error) {
+	result := block{env: env}
+	value, ok := mapping[key]
+	if !ok || value == nil {
+		return result, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		if operations, ok := value.([]map[string]interface{}); ok {
+			result.operations = operations
+			return result, nil
+		}
+		return result, fmt.Errorf("%s must be a list of operations", key)
+	}
+	for i, v := range list {
+		operation, ok := v.(map[string]interface{})
+		if !ok {
+			return result, fmt.Errorf("%s operation %d is not an object", key, i)
+		}
+		result.operations = append(result.operations, operation)
+	}
+	return result, nil
+}
+
+//Runs the then block if the condition holds, otherwise the else block.
+//Conditions are objects, where every key must hold:
+//variable with equals, notEquals, in, notIn, greaterThan or lessThan; file, which must exist in the server folder;
+//success, which is if the previous operation succeeded; os; and all, any and not to combine other conditions.
+type ifOperation struct {
+	condition      interface{}
+	then           block
+	otherwise      block
+	data           map[string]interface{}
+	previousFailed bool
+}
+
+func createIf(mapping map[string]interface{}, data map[string]interface{}, env map[string]string) (ops.Operation, error) {
+	condition, ok := mapping["if"]
+	if !ok {
+		return nil, errors.New("no condition given")
+	}
+
+	then, err := getBlock(mapping, "then", env)
+	if err != nil {
+		return nil, err
+	}
+	otherwise, err := getBlock(mapping, "else", env)
+	if err != nil {
+		return nil, err
+	}
+	return &ifOperation{condition: condition, then: then, otherwise: otherwise, data: data}, nil
+}
+
+func (o *ifOperation) Run(env environments.Environment) error {
+	condition, err := commons.ReplaceTokensInValue(o.condition, o.data)
+	if err != nil {
+		return err
+	}
+
+	result, err := o.evaluate(condition, env)
+	if err != nil {
+		return fmt.Errorf("invalid condition: %s", err.Error())
+	}
+	logging.Debugf("Condition %v is %t", condition, result)
+
+	if result {
+		return o.then.run(env, o.data)
+	}
+	return o.otherwise.run(env, o.data)
+}
+
+func (o *ifOperation) evaluate(condition interface{}, env environments.Environment) (bool, error) {
+	c, ok := condition.(map[string]interface{})
+	if !ok {
+		switch v := condition.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		case []interface{}:
+			return o.evaluate(map[string]interface{}{"all": v}, env)
+		}
+		return false, fmt.Errorf("unknown condition %v", condition)
+	}
+
+	if name, ok := c["variable"]; ok {
+		if result, err := compareVariable(fmt.Sprint(name), c, o.data); err != nil || !result {
+			return false, err
+		}
+	}
+
+	for key, value := range c {
+		var result bool
+		var err error
+		switch key {
+		case "variable", "equals", "notEquals", "in", "notIn", "greaterThan", "lessThan":
+			if _, ok := c["variable"]; !ok {
+				return false, fmt.Errorf("%s needs a variable", key)
+			}
+			continue
+		case "file":
+			result, err = fileExists(env, fmt.Sprint(value))
+		case "success":
+			success, ok := value.(bool)
+			if !ok {
+				return false, errors.New("success must be true or false")
+			}
+			result = success != o.previousFailed
+		case "os":
+			result = common.ContainsValue(common.ToStringArray(value), runtime.GOOS)
+		case "all", "any":
+			list, ok := value.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("%s must be a list of conditions", key)
+			}
+			result = key == "all"
+			for _, item := range list {
+				matched, err := o.evaluate(item, env)
+				if err != nil {
+					return false, err
+				}
+				if matched != result {
+					result = matched
+					break
+				}
+			}
+		case "not":
+			result, err = o.evaluate(value, env)
+			result = !result
+		default:
+			return false, fmt.Errorf("unknown condition %s", key)
+		}
+		if err != nil || !result {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func compareVariable(name string, c map[string]interface{}, data map[string]interface{}) (bool, error) {
+	value := ""
+	if v, ok := data[name]; ok && v != nil {
+		value = fmt.Sprint(v)
+	}
+
+	if expected, ok := c["equals"]; ok && value != fmt.Sprint(expected) {
+		return false, nil
+	}
+	if expected, ok := c["notEquals"]; ok && value == fmt.Sprint(expected) {
+		return false, nil
+	}
+	if expected, ok := c["in"]; ok && !common.ContainsValue(common.ToStringArray(expected), value) {
+		return false, nil
+	}
+	if expected, ok := c["notIn"]; ok && common.ContainsValue(common.ToStringArray(expected), value) {
+		return false, nil
+	}
+
+	for key, greater := range map[string]bool{"greaterThan": true, "lessThan": false} {
+		expected, ok := c[key]
+		if !ok {
+			continue
+		}
+		actual, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false, fmt.Errorf("%s is not a number", name)
+		}
+		limit, err := strconv.ParseFloat(fmt.Sprint(expected), 64)
+		if err != nil {
+			return false, fmt.Errorf("%s of %s is not a number", key, name)
+		}
+		if (greater && actual <= limit) || (!greater && actual >= limit) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func fileExists(env environments.Environment, file string) (bool, error) {
+	root, err := filepath.Abs(env.GetRootDirectory())
+	if err != nil {
+		return false, err
+	}
+	target, err := commons.ResolvePath(root, file)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(target)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//Runs the operations once for each item of a list, which is either a data variable or given directly.
+//The item and its index are available to the operations as variables, named by as and as + "Index".
+type foreachOperation struct {
+	variable   string
+	items      interface{}
+	as         string
+	operations block
+	data       map[string]interface{}
+}
+
+func createForeach(mapping map[string]interface{}, data map[string]interface{}, env map[string]string) (ops.Operation, error) {
+	operations, err := getBlock(mapping, "operations", env)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &foreachOperation{
+		variable:   common.GetStringOrDefault(mapping, "variable", ""),
+		items:      mapping["items"],
+		as:         common.GetStringOrDefault(mapping, "as", "item"),
+		operations: operations,
+		data:       data,
+	}
+	if op.variable == "" && op.items == nil {
+		return nil, errors.New("no variable or items given")
+	}
+	return op, nil
+}
+
+func (o *foreachOperation) Run(env environments.Environment) error {
+	var items []string
+	if o.variable != "" {
+		value, ok := o.data[o.variable]
+		if !ok {
+			return fmt.Errorf("undefined variable %s", o.variable)
+		}
+		items = toList(value)
+	} else {
+		value, err := commons.ReplaceTokensInValue(o.items, o.data)
+		if err != nil {
+			return err
+		}
+		items = toList(value)
+	}
+
+	for i, item := range items {
+		data := make(map[string]interface{}, len(o.data)+2)
+		for k, v := range o.data {
+			data[k] = v
+		}
+		data[o.as] = item
+		data[o.as+"Index"] = i
+
+		err := o.operations.run(env, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Lists are either json arrays or comma separated strings
+func toList(value interface{}) []string {
+	if v, ok := value.(string); ok {
+		result := make([]string, 0)
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+		return result
+	}
+	return common.ToStringArray(value)
+}
+
+//Runs the operations, and if one fails runs the onError operations instead of failing.
+//The error is available to them as the error variable.
+type tryOperation struct {
+	operations block
+	onError    block
+	data       map[string]interface{}
+}
+
+func createTry(mapping map[string]interface{}, data map[string]interface{}, env map[string]string) (ops.Operation, error) {
+	operations, err := getBlock(mapping, "operations", env)
+	if err != nil {
+		return nil, err
+	}
+	onError, err := getBlock(mapping, "onError", env)
+	if err != nil {
+		return nil, err
+	}
+	return &tryOperation{operations: operations, onError: onError, data: data}, nil
+}
+
+func (o *tryOperation) Run(env environments.Environment) error {
+	err := o.operations.run(env, o.data)
+	if err == nil || err == environments.ErrCancelled {
+		return err
+	}
+
+	logging.Debugf("Operations failed, running error handler: %s", err.Error())
+	data := make(map[string]interface{}, len(o.data)+1)
+	for k, v := range o.data {
+		data[k] = v
+	}
+	data["error"] = err.Error()
+	return o.onError.run(env, data)
+}
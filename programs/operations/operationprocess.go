@@ -17,15 +17,20 @@
 package operations
 
 import (
-	"github.com/pufferpanel/apufferi/common"
+	"fmt"
 	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
 	"github.com/pufferpanel/pufferd/environments"
 	"github.com/pufferpanel/pufferd/programs/operations/ops"
+	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/archive"
 	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/command"
 	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/download"
+	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/editfile"
+	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/extract"
 	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/mkdir"
 	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/mojangdl"
 	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/move"
+	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/replace"
 	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/spongeforgedl"
 	"github.com/pufferpanel/pufferd/programs/operations/ops/impl/writefile"
 )
@@ -40,7 +45,7 @@ func LoadOperations() {
 	loadOpModules()
 }
 
-func GenerateProcess(directions []map[string]interface{}, environment environments.Environment, dataMapping map[string]interface{}, env map[string]string) OperationProcess {
+func GenerateProcess(directions []map[string]interface{}, environment environments.Environment, dataMapping map[string]interface{}, env map[string]string) (OperationProcess, error) {
 	dataMap := make(map[string]interface{})
 	for k, v := range dataMapping {
 		dataMap[k] = v
@@ -50,36 +55,50 @@ func GenerateProcess(directions []map[string]interface{}, environment environmen
 	dataMap["rootdir"] = environment.GetRootDirectory()
 
 	dataMap["rootDir"] = environment.GetRootDirectory()
+
+	envMap, err := commons.ReplaceTokensInMap(env, dataMap)
+	if err != nil {
+		return OperationProcess{}, fmt.Errorf("environment variable %s", err.Error())
+	}
+
 	operationList := make([]ops.Operation, 0)
-	for _, mapping := range directions {
+	for i, mapping := range directions {
+		typeName, _ := mapping["type"].(string)
+		continueOnError, _ := mapping["continueOnError"].(bool)
+
+		//blocks are generated when they run, so they see the data of that point such as the foreach item
+		if create, ok := controlMapping[typeName]; ok {
+			op, err := create(mapping, dataMap, env)
+			if err != nil {
+				return OperationProcess{}, fmt.Errorf("operation %d (%s): %s", i, typeName, err.Error())
+			}
+			if continueOnError {
+				op = continueOnErrorOperation{op}
+			}
+			operationList = append(operationList, op)
+			continue
+		}
 
-		factory := commandMapping[mapping["type"].(string)]
+		factory, ok := commandMapping[typeName]
+		if !ok {
+			return OperationProcess{}, fmt.Errorf("operation %d has unknown type %s", i, typeName)
+		}
 
-		mapCopy := make(map[string]interface{}, 0)
+		mapCopy := make(map[string]interface{}, len(mapping))
 
 		//replace tokens
 		for k, v := range mapping {
-			if k != "type" {
+			if k == "type" || k == "continueOnError" {
+				mapCopy[k] = v
 				continue
 			}
 
-			switch v.(type) {
-			case string: {
-				mapCopy[k] = common.ReplaceTokens(v.(string), dataMap)
-			}
-			case []string: {
-				mapCopy[k] = common.ReplaceTokensInArr(v.([]string), dataMap)
-			}
-			case map[string]string: {
-				mapCopy[k] = common.ReplaceTokensInMap(v.(map[string]string), dataMap)
-			}
-			default:
-				mapCopy[k] = v
+			mapCopy[k], err = commons.ReplaceTokensInValue(v, dataMap)
+			if err != nil {
+				return OperationProcess{}, fmt.Errorf("operation %d (%s) argument %s: %s", i, typeName, k, err.Error())
 			}
 		}
 
-		envMap := common.ReplaceTokensInMap(env, dataMap)
-
 		opCreate := ops.CreateOperation{
 			OperationArgs:        mapCopy,
 			EnvironmentVariables: envMap,
@@ -87,14 +106,19 @@ func GenerateProcess(directions []map[string]interface{}, environment environmen
 		}
 
 		op := factory.Create(opCreate)
+		if continueOnError {
+			op = continueOnErrorOperation{op}
+		}
 
 		operationList = append(operationList, op)
 	}
-	return OperationProcess{processInstructions: operationList}
+	return OperationProcess{processInstructions: operationList}, nil
 }
 
 type OperationProcess struct {
 	processInstructions []ops.Operation
+	//if the last operation failed, which can only be seen when it was allowed to
+	previousFailed bool
 }
 
 func (p *OperationProcess) Run(env environments.Environment) (err error) {
@@ -109,12 +133,39 @@ func (p *OperationProcess) Run(env environments.Environment) (err error) {
 }
 
 func (p *OperationProcess) RunNext(env environments.Environment) error {
+	if job := env.GetJob(); job != nil && job.Cancelled() {
+		return environments.ErrCancelled
+	}
+
 	var op ops.Operation
 	op, p.processInstructions = p.processInstructions[0], p.processInstructions[1:]
+
+	allowed, continueOnError := op.(continueOnErrorOperation)
+	if continueOnError {
+		op = allowed.Operation
+	}
+	if condition, ok := op.(*ifOperation); ok {
+		condition.previousFailed = p.previousFailed
+	}
+
 	err := op.Run(env)
+	p.previousFailed = err != nil
+	if err == environments.ErrCancelled {
+		return err
+	}
+	if err != nil && continueOnError {
+		logging.Error("Error running operation, continuing: ", err)
+		env.DisplayToConsole("Operation failed, continuing: %s\n", err.Error())
+		return nil
+	}
 	return err
 }
 
+//Gets how many operations are left to run
+func (p *OperationProcess) Remaining() int {
+	return len(p.processInstructions)
+}
+
 func (p *OperationProcess) HasNext() bool {
 	return len(p.processInstructions) != 0 && p.processInstructions[0] != nil
 }
@@ -140,4 +191,16 @@ func loadCoreModules() {
 
 	spongeforgeDlFactory := spongeforgedl.Factory
 	commandMapping[spongeforgeDlFactory.Key()] = spongeforgeDlFactory
+
+	extractFactory := extract.Factory
+	commandMapping[extractFactory.Key()] = extractFactory
+
+	archiveFactory := archive.Factory
+	commandMapping[archiveFactory.Key()] = archiveFactory
+
+	editFileFactory := editfile.Factory
+	commandMapping[editFileFactory.Key()] = editFileFactory
+
+	replaceFactory := replace.Factory
+	commandMapping[replaceFactory.Key()] = replaceFactory
 }
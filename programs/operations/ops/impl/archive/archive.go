@@ -0,0 +1,271 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/programs/operations/ops"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Packs files of the server into an archive. Entries are named relative to the server folder.
+type Archive struct {
+	Sources []string
+	Target  string
+	Format  string
+	Exclude []string
+}
+
+type archiveWriter interface {
+	add(name, file string, info os.FileInfo) error
+
+	Close() error
+}
+
+func (a Archive) Run(env environments.Environment) error {
+	root, err := filepath.Abs(env.GetRootDirectory())
+	if err != nil {
+		return err
+	}
+
+	target, err := commons.ResolvePath(root, a.Target)
+	if err != nil {
+		return err
+	}
+
+	format := a.Format
+	if format == "" {
+		format = commons.GetArchiveFormat(target)
+	}
+
+	logging.Debugf("Archiving %s to %s as %s", strings.Join(a.Sources, ", "), target, format)
+	env.DisplayToConsole("Creating archive %s\n", a.Target)
+
+	files := make([]string, 0)
+	for _, source := range a.Sources {
+		pattern, err := commons.ResolvePath(root, source)
+		if err != nil {
+			return err
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("no files match %s", source)
+		}
+		files = append(files, matches...)
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(target + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(target + ".tmp")
+
+	var writer archiveWriter
+	switch format {
+	case commons.ArchiveZip:
+		writer = &zipWriter{zip.NewWriter(out)}
+	case commons.ArchiveTar:
+		writer = &tarWriter{writer: tar.NewWriter(out)}
+	case commons.ArchiveTarGz:
+		gz := gzip.NewWriter(out)
+		writer = &tarWriter{writer: tar.NewWriter(gz), compression: gz}
+	case commons.ArchiveTarXz:
+		compression, err := xz.NewWriter(out)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		writer = &tarWriter{writer: tar.NewWriter(compression), compression: compression}
+	default:
+		out.Close()
+		return fmt.Errorf("unknown archive format for %s", a.Target)
+	}
+
+	count := 0
+	for _, file := range files {
+		err = filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == target || path == target+".tmp" {
+				return nil
+			}
+
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			name = filepath.ToSlash(name)
+			if name == "." {
+				return nil
+			}
+			if !commons.MatchArchiveName(name, nil, a.Exclude) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+			count++
+			return writer.add(name, path, info)
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	if cErr := writer.Close(); err == nil {
+		err = cErr
+	}
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(target+".tmp", target)
+	if err != nil {
+		return err
+	}
+
+	env.DisplayToConsole("Added %d files to %s\n", count, a.Target)
+	return nil
+}
+
+type zipWriter struct {
+	writer *zip.Writer
+}
+
+func (z *zipWriter) add(name, file string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	} else {
+		header.Method = zip.Deflate
+	}
+
+	w, err := z.writer.CreateHeader(header)
+	if err != nil || info.IsDir() {
+		return err
+	}
+
+	//symlinks are stored as links, never followed, so nothing outside the server can be added
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(file)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(link))
+		return err
+	}
+	return copyFile(w, file)
+}
+
+func (z *zipWriter) Close() error {
+	return z.writer.Close()
+}
+
+type tarWriter struct {
+	writer      *tar.Writer
+	compression io.WriteCloser
+}
+
+func (t *tarWriter) add(name, file string, info os.FileInfo) (err error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(file); err != nil {
+			return
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err = t.writer.WriteHeader(header); err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	return copyFile(t.writer, file)
+}
+
+func (t *tarWriter) Close() error {
+	err := t.writer.Close()
+	if t.compression != nil {
+		if cErr := t.compression.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+type ArchiveOperationFactory struct {
+}
+
+func (of ArchiveOperationFactory) Create(op ops.CreateOperation) ops.Operation {
+	sources := common.ToStringArray(op.OperationArgs["source"])
+	target := common.GetStringOrDefault(op.OperationArgs, "target", "")
+	format := common.GetStringOrDefault(op.OperationArgs, "format", "")
+	exclude := common.ToStringArray(op.OperationArgs["exclude"])
+	return Archive{Sources: sources, Target: target, Format: format, Exclude: exclude}
+}
+
+func (of ArchiveOperationFactory) Key() string {
+	return "archive"
+}
+
+var Factory ArchiveOperationFactory
@@ -17,22 +17,32 @@
 package download
 
 import (
-	"github.com/cavaliercoder/grab"
+	"errors"
+	"github.com/pufferpanel/apufferi/common"
 	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
 	"github.com/pufferpanel/pufferd/environments"
-	"github.com/pufferpanel/apufferi/common"
 	"github.com/pufferpanel/pufferd/programs/operations/ops"
 )
 
 type Download struct {
-	Files        []string
+	Files []DownloadFile
+}
+
+//A file to download, given either as just the url or as an object with the url, target and a sha1 or sha256 checksum
+type DownloadFile struct {
+	Url      string
+	Target   string
+	Checksum commons.Checksum
 }
 
 func (d Download) Run(env environments.Environment) error {
 	for _, file := range d.Files {
-		logging.Debugf("Download file from %s to %s", file, env.GetRootDirectory())
-		env.DisplayToConsole("Downloading file %s\n", file)
-		_, err := grab.Get(env.GetRootDirectory(), file)
+		if file.Url == "" {
+			return errors.New("download has no url")
+		}
+		logging.Debugf("Download file from %s to %s", file.Url, env.GetRootDirectory())
+		err := commons.DownloadFile(file.Url, file.Target, file.Checksum, env)
 		if err != nil {
 			return err
 		}
@@ -43,8 +53,36 @@ func (d Download) Run(env environments.Environment) error {
 type DownloadOperationFactory struct {
 }
 
-func (of DownloadOperationFactory) 	Create(op ops.CreateOperation) ops.Operation {
-	files := common.ToStringArray(op.OperationArgs["files"])
+func (of DownloadOperationFactory) Create(op ops.CreateOperation) ops.Operation {
+	var entries []interface{}
+	switch v := op.OperationArgs["files"].(type) {
+	case []interface{}:
+		entries = v
+	case nil:
+	default:
+		for _, file := range common.ToStringArray(v) {
+			entries = append(entries, file)
+		}
+	}
+
+	files := make([]DownloadFile, 0, len(entries))
+	for _, entry := range entries {
+		switch v := entry.(type) {
+		case string:
+			files = append(files, DownloadFile{Url: v})
+		case map[string]interface{}:
+			file := DownloadFile{
+				Url:    common.GetStringOrDefault(v, "url", ""),
+				Target: common.GetStringOrDefault(v, "target", ""),
+			}
+			if sum := common.GetStringOrDefault(v, "sha256", ""); sum != "" {
+				file.Checksum = commons.Checksum{Type: "sha256", Value: sum}
+			} else if sum := common.GetStringOrDefault(v, "sha1", ""); sum != "" {
+				file.Checksum = commons.Checksum{Type: "sha1", Value: sum}
+			}
+			files = append(files, file)
+		}
+	}
 	return &Download{Files: files}
 }
 
@@ -52,4 +90,4 @@ func (of DownloadOperationFactory) Key() string {
 	return "download"
 }
 
-var Factory DownloadOperationFactory
\ No newline at end of file
+var Factory DownloadOperationFactory
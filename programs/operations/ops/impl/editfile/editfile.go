@@ -0,0 +1,186 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package editfile
+
+import (
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/programs/operations/ops"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	FormatProperties = "properties"
+	FormatJson       = "json"
+	FormatYaml       = "yaml"
+	FormatToml       = "toml"
+	FormatIni        = "ini"
+)
+
+//Edits keys in a config file, leaving the rest of the file as it is.
+//Merge is applied first, then set, then delete.
+//Keys are paths split by dots, such as settings.port, except in properties files where the dots are part of the key.
+//In ini and toml files, the last part is the key and the rest the section it is in.
+//Values keep the type of the value they replace, so "25565" replaces a number with a number, new values are written as they are given.
+type EditFile struct {
+	Target string
+	Format string
+	Set    map[string]interface{}
+	Delete []string
+	Merge  map[string]interface{}
+	Create bool
+}
+
+//A file which has been read and can have its keys changed
+type document interface {
+	set(key string, value interface{}) error
+	delete(key string) bool
+	bytes() ([]byte, error)
+}
+
+func (e EditFile) Run(env environments.Environment) error {
+	target, err := commons.ResolvePath(env.GetRootDirectory(), e.Target)
+	if err != nil {
+		return err
+	}
+
+	format := e.Format
+	if format == "" {
+		format = GetFormat(target)
+	}
+
+	mode := os.FileMode(0644)
+	data, err := ioutil.ReadFile(target)
+	if os.IsNotExist(err) && e.Create {
+		data, err = []byte{}, nil
+	} else if err != nil {
+		return err
+	} else if info, err := os.Stat(target); err == nil {
+		mode = info.Mode()
+	}
+
+	var doc document
+	switch format {
+	case FormatProperties, FormatIni, FormatToml:
+		doc = parseLines(data, format)
+	case FormatJson:
+		doc, err = parseJson(data)
+	case FormatYaml:
+		doc, err = parseYaml(data)
+	default:
+		return fmt.Errorf("unknown config format for %s", e.Target)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", e.Target, err.Error())
+	}
+
+	logging.Debugf("Editing %s as %s", target, format)
+	env.DisplayToConsole("Editing %s\n", e.Target)
+
+	values := make(map[string]interface{})
+	flatten("", e.Merge, values)
+	for k, v := range e.Set {
+		values[k] = v
+	}
+
+	//keys are sorted so new keys are always added in the same order
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = doc.set(k, values[k]); err != nil {
+			return fmt.Errorf("could not set %s: %s", k, err.Error())
+		}
+	}
+
+	for _, k := range e.Delete {
+		doc.delete(k)
+	}
+
+	result, err := doc.bytes()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, result, mode)
+}
+
+//Gets the config format from the extension of the file, or an empty string if it is not known
+func GetFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".properties":
+		return FormatProperties
+	case ".json":
+		return FormatJson
+	case ".yml", ".yaml":
+		return FormatYaml
+	case ".toml":
+		return FormatToml
+	case ".ini", ".cfg", ".conf":
+		return FormatIni
+	}
+	return ""
+}
+
+//Turns nested objects into keys joined by dots, so merging can be done by setting each value
+func flatten(prefix string, value map[string]interface{}, result map[string]interface{}) {
+	for k, v := range value {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			flatten(k, child, result)
+		} else {
+			result[k] = v
+		}
+	}
+}
+
+type EditFileOperationFactory struct {
+}
+
+func (of EditFileOperationFactory) Create(op ops.CreateOperation) ops.Operation {
+	target := common.GetStringOrDefault(op.OperationArgs, "target", "")
+	format := common.GetStringOrDefault(op.OperationArgs, "format", "")
+	set, _ := op.OperationArgs["set"].(map[string]interface{})
+	merge, _ := op.OperationArgs["merge"].(map[string]interface{})
+	remove := common.ToStringArray(op.OperationArgs["delete"])
+
+	create := true
+	if v, ok := op.OperationArgs["create"].(bool); ok {
+		create = v
+	}
+
+	return EditFile{Target: target, Format: strings.ToLower(format), Set: set, Delete: remove, Merge: merge, Create: create}
+}
+
+func (of EditFileOperationFactory) Key() string {
+	return "editfile"
+}
+
+var Factory EditFileOperationFactory
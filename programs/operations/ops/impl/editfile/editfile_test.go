@@ -0,0 +1,281 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+
+package editfile
+
+import (
+	"github.com/pufferpanel/pufferd/environments"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Only gives the folder files are edited in, which is all editing needs
+type testEnvironment struct {
+	environments.Environment
+	root string
+}
+
+func (e testEnvironment) GetRootDirectory() string {
+	return e.root
+}
+
+func (e testEnvironment) DisplayToConsole(msg string, data ...interface{}) {
+}
+
+func TestEditFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		input   string
+		set     map[string]interface{}
+		merge   map[string]interface{}
+		delete  []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "properties keeps comments",
+			target: "server.properties",
+			input:  "#Minecraft server properties\nserver-port=25565\n#the message\nmotd=A Server\n",
+			set:    map[string]interface{}{"server-port": "25566", "motd": "Other"},
+			want:   "#Minecraft server properties\nserver-port=25566\n#the message\nmotd=Other\n",
+		},
+		{
+			name:   "properties adds keys with dots",
+			target: "server.properties",
+			input:  "server-port=25565\n",
+			set:    map[string]interface{}{"level.name": "world"},
+			want:   "server-port=25565\nlevel.name=world\n",
+		},
+		{
+			name:   "properties keeps crlf",
+			target: "server.properties",
+			input:  "a=1\r\nb=2\r\n",
+			set:    map[string]interface{}{"b": "3", "c": "4"},
+			want:   "a=1\r\nb=3\r\nc=4\r\n",
+		},
+		{
+			name:   "properties keeps missing trailing newline",
+			target: "server.properties",
+			input:  "a=1",
+			set:    map[string]interface{}{"a": "2"},
+			want:   "a=2",
+		},
+		{
+			name:    "properties refuses value over several lines",
+			target:  "server.properties",
+			input:   "a=1, \\\n  2\nb=3\n",
+			set:     map[string]interface{}{"a": "4"},
+			wantErr: true,
+		},
+		{
+			name:   "properties deletes value over several lines",
+			target: "server.properties",
+			input:  "a=1, \\\n  2\nb=3\n",
+			delete: []string{"a"},
+			want:   "b=3\n",
+		},
+		{
+			name:   "ini adds key to its section",
+			target: "settings.ini",
+			input:  "; settings\n[a]\nx=1\n\n[b]\ny=2\n",
+			set:    map[string]interface{}{"a.z": "3"},
+			want:   "; settings\n[a]\nx=1\nz=3\n\n[b]\ny=2\n",
+		},
+		{
+			name:   "ini adds missing section",
+			target: "settings.ini",
+			input:  "[a]\nx=1\n",
+			set:    map[string]interface{}{"b.y": "2"},
+			want:   "[a]\nx=1\n\n[b]\ny=2\n",
+		},
+		{
+			name:   "ini adds key without section before the first section",
+			target: "settings.ini",
+			input:  "x=1\n\n[a]\ny=2\n",
+			set:    map[string]interface{}{"z": "3"},
+			want:   "x=1\nz=3\n\n[a]\ny=2\n",
+		},
+		{
+			name:   "toml keeps types",
+			target: "config.toml",
+			input:  "port = 25565\nname = \"x\"\nliteral = 'y'\nenabled = false\n",
+			set:    map[string]interface{}{"port": "25566", "name": "25566", "literal": "z", "enabled": "true"},
+			want:   "port = 25566\nname = \"25566\"\nliteral = 'z'\nenabled = true\n",
+		},
+		{
+			name:   "toml keeps comments after values",
+			target: "config.toml",
+			input:  "port = 25565 # the port\nmotd = \"a # b\"  # not part of the value\nempty = # nothing yet\n",
+			set:    map[string]interface{}{"port": "1", "motd": "c", "empty": "d"},
+			want:   "port = 1 # the port\nmotd = \"c\"  # not part of the value\nempty = \"d\" # nothing yet\n",
+		},
+		{
+			name:   "toml adds key to its section",
+			target: "config.toml",
+			input:  "# settings\n[server]\nport = 1\n\n[world]\nname = \"x\"\n",
+			set:    map[string]interface{}{"server.ip": "0.0.0.0", "world.seed": 5},
+			want:   "# settings\n[server]\nport = 1\nip = \"0.0.0.0\"\n\n[world]\nname = \"x\"\nseed = 5\n",
+		},
+		{
+			name:    "toml refuses array over several lines",
+			target:  "config.toml",
+			input:   "list = [\n  1,\n  2,\n]\n",
+			set:     map[string]interface{}{"list": []interface{}{3}},
+			wantErr: true,
+		},
+		{
+			name:    "toml refuses string over several lines",
+			target:  "config.toml",
+			input:   "text = '''\nline\n'''\n",
+			set:     map[string]interface{}{"text": "x"},
+			wantErr: true,
+		},
+		{
+			name:   "toml ignores keys inside strings over several lines",
+			target: "config.toml",
+			input:  "text = \"\"\"\nkey = \\\"\"\"\n[section]\n\"\"\"\nother = 1\n",
+			set:    map[string]interface{}{"key": "2"},
+			want:   "text = \"\"\"\nkey = \\\"\"\"\n[section]\n\"\"\"\nother = 1\nkey = \"2\"\n",
+		},
+		{
+			name:   "toml adds key after array over several lines",
+			target: "config.toml",
+			input:  "[s]\nlist = [\n  \"a\", # first\n]\n\n[t]\n",
+			set:    map[string]interface{}{"s.x": true},
+			want:   "[s]\nlist = [\n  \"a\", # first\n]\nx = true\n\n[t]\n",
+		},
+		{
+			name:   "toml deletes array over several lines",
+			target: "config.toml",
+			input:  "a = 1\nlist = [\n  1,\n]\nb = 2\n",
+			delete: []string{"list"},
+			want:   "a = 1\nb = 2\n",
+		},
+		{
+			name:   "json merges, sets and deletes",
+			target: "config.json",
+			input:  `{"a": {"b": 1, "c": 2}, "d": 3, "e": true}`,
+			merge:  map[string]interface{}{"a": map[string]interface{}{"b": "5", "f": "new"}},
+			set:    map[string]interface{}{"e": "false"},
+			delete: []string{"d", "a.c"},
+			want:   "{\n  \"a\": {\n    \"b\": 5,\n    \"f\": \"new\"\n  },\n  \"e\": false\n}\n",
+		},
+		{
+			name:   "json set wins over merge",
+			target: "config.json",
+			input:  `{"a": {"b": 1}}`,
+			merge:  map[string]interface{}{"a": map[string]interface{}{"b": "2"}},
+			set:    map[string]interface{}{"a.b": "3"},
+			want:   "{\n  \"a\": {\n    \"b\": 3\n  }\n}\n",
+		},
+		{
+			name:    "json refuses key below a value",
+			target:  "config.json",
+			input:   `{"a": 1}`,
+			set:     map[string]interface{}{"a.b": "2"},
+			wantErr: true,
+		},
+		{
+			name:   "yaml keeps order and types",
+			target: "config.yml",
+			input:  "z: 1\na:\n  port: 25565\n  online: true\nlist:\n- x\n",
+			set:    map[string]interface{}{"a.port": "25566", "a.online": "false", "a.name": "new"},
+			delete: []string{"list"},
+			want:   "z: 1\na:\n  port: 25566\n  online: false\n  name: new\n",
+		},
+		{
+			name:   "yaml keeps comments",
+			target: "config.yml",
+			input:  "# settings\nserver:\n  # the port\n  port: 25565 # default\n  name: 'a # b'\n  motd: |\n    line: 1\n    port: 2\nother: x\n",
+			set:    map[string]interface{}{"server.port": "25566", "server.name": "c", "server.motd": "d", "other": "y"},
+			want:   "# settings\nserver:\n  # the port\n  port: 25566 # default\n  name: c\n  motd: d\nother: \"y\"\n",
+		},
+		{
+			name:   "yaml adds keys to their mapping",
+			target: "config.yml",
+			input:  "a:\n    b: 1\n# end of a\nc: ~ # nothing yet\n",
+			set:    map[string]interface{}{"a.d": "2", "c.e.f": true, "g": []interface{}{"x", "y"}},
+			want:   "a:\n    b: 1\n    d: \"2\"\n# end of a\nc: # nothing yet\n  e:\n    f: true\ng:\n  - x\n  - \"y\"\n",
+		},
+		{
+			name:   "yaml ignores keys inside lists",
+			target: "config.yml",
+			input:  "list:\n- name: a\n  port: 1\nport: 2\n",
+			set:    map[string]interface{}{"port": "3"},
+			delete: []string{"name"},
+			want:   "list:\n- name: a\n  port: 1\nport: 3\n",
+		},
+		{
+			name:    "yaml refuses key below a value",
+			target:  "config.yml",
+			input:   "a: 1\n",
+			set:     map[string]interface{}{"a.b": "2"},
+			wantErr: true,
+		},
+		{
+			name:   "properties escapes values",
+			target: "server.properties",
+			input:  "motd=A Server\n",
+			set:    map[string]interface{}{"motd": " C:\\path\nnext=1 \u00a7a\U0001F600", "new key": "#1"},
+			want:   "motd=\\ C\\:\\\\path\\nnext\\=1 \\u00A7a\\uD83D\\uDE00\nnew\\ key=\\#1\n",
+		},
+		{
+			name:   "creates missing file",
+			target: "folder/new.properties",
+			set:    map[string]interface{}{"a": "1"},
+			want:   "a=1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "editfile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			target := filepath.Join(root, tt.target)
+			if tt.input != "" {
+				if err = ioutil.WriteFile(target, []byte(tt.input), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			op := EditFile{Target: tt.target, Set: tt.set, Merge: tt.merge, Delete: tt.delete, Create: true}
+			err = op.Run(testEnvironment{root: root})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			data, err := ioutil.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if tt.wantErr {
+				want = tt.input
+			}
+			if string(data) != want {
+				t.Errorf("Run() wrote %q, want %q", string(data), want)
+			}
+		})
+	}
+}
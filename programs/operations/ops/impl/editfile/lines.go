@@ -0,0 +1,423 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package editfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+//Numbers and booleans, which toml writes without quotes
+var tomlBareValue = regexp.MustCompile(`^([+-]?[0-9][0-9_]*(\.[0-9_]+)?([eE][+-]?[0-9]+)?|true|false)$`)
+
+//Properties, ini and toml files are edited a line at a time, so comments and formatting are kept
+type lineDocument struct {
+	format   string
+	lines    []string
+	newline  string
+	trailing bool
+}
+
+type lineInfo struct {
+	isKey     bool
+	isSection bool
+	section   string
+	key       string
+	valueAt   int
+	//where the value ends, anything after it such as a comment is kept
+	valueEnd int
+	//the value goes on over the lines after it
+	multiline bool
+	//the line is part of the value of a key on an earlier line
+	continued bool
+}
+
+//Tracks a toml value while it is read, as strings with three quotes and arrays can go over several lines
+type tomlValue struct {
+	depth     int
+	delimiter string
+}
+
+func parseLines(data []byte, format string) *lineDocument {
+	doc := &lineDocument{format: format, newline: "\n", trailing: true}
+	text := string(data)
+	if strings.Contains(text, "\r\n") {
+		doc.newline = "\r\n"
+	}
+	if text == "" {
+		return doc
+	}
+
+	doc.lines = strings.Split(text, doc.newline)
+	if doc.lines[len(doc.lines)-1] == "" {
+		doc.lines = doc.lines[:len(doc.lines)-1]
+	} else {
+		doc.trailing = false
+	}
+	return doc
+}
+
+func (d *lineDocument) scan() []lineInfo {
+	result := make([]lineInfo, len(d.lines))
+	section := ""
+	var value *tomlValue
+	continued := false
+	for i, line := range d.lines {
+		if continued {
+			result[i] = lineInfo{continued: true, section: section}
+			if value != nil {
+				value.scanLine(line, 0)
+				continued = value.open()
+			} else {
+				continued = escapesNewline(line)
+			}
+			continue
+		}
+
+		info := d.parseLine(line)
+		if info.isSection {
+			section = info.section
+		} else {
+			info.section = section
+		}
+		if info.isKey {
+			info.valueEnd = len(line)
+			value = nil
+			if d.format == FormatToml {
+				value = &tomlValue{}
+				if comment := value.scanLine(line, info.valueAt); comment != -1 {
+					info.valueEnd = len(strings.TrimRight(line[:comment], " \t"))
+					if info.valueEnd < info.valueAt {
+						info.valueEnd = info.valueAt
+					}
+				}
+				info.multiline = value.open()
+			} else if d.format == FormatProperties {
+				info.multiline = escapesNewline(line)
+			}
+			continued = info.multiline
+		}
+		result[i] = info
+	}
+	return result
+}
+
+//Reads the part of a value on the line from start, and gives where the comment after it starts, or -1 if there is none
+func (v *tomlValue) scanLine(line string, start int) int {
+	for i := start; i < len(line); i++ {
+		if v.delimiter != "" {
+			if line[i] == '\\' && v.delimiter[0] == '"' {
+				i++
+			} else if strings.HasPrefix(line[i:], v.delimiter) {
+				i += len(v.delimiter) - 1
+				v.delimiter = ""
+			}
+			continue
+		}
+
+		switch c := line[i]; c {
+		case '#':
+			return i
+		case '"', '\'':
+			v.delimiter = string(c)
+			if strings.HasPrefix(line[i:], strings.Repeat(v.delimiter, 3)) {
+				v.delimiter = strings.Repeat(v.delimiter, 3)
+				i += 2
+			}
+		case '[', '{':
+			v.depth++
+		case ']', '}':
+			v.depth--
+		}
+	}
+	//only strings with three quotes go on to the next line
+	if len(v.delimiter) == 1 {
+		v.delimiter = ""
+	}
+	return -1
+}
+
+func (v *tomlValue) open() bool {
+	return v.depth > 0 || v.delimiter != ""
+}
+
+//Determines if a properties line ends in a backslash, which carries the value on to the next line
+func escapesNewline(line string) bool {
+	count := len(line) - len(strings.TrimRight(line, "\\"))
+	return count%2 == 1
+}
+
+func (d *lineDocument) parseLine(line string) (info lineInfo) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return
+	}
+
+	comments := "#;"
+	if d.format == FormatProperties {
+		comments = "#!"
+	} else if d.format == FormatToml {
+		comments = "#"
+	}
+	if strings.ContainsAny(trimmed[:1], comments) {
+		return
+	}
+
+	if d.format != FormatProperties && trimmed[0] == '[' {
+		end := strings.Index(trimmed, "]")
+		if end == -1 {
+			return
+		}
+		info.isSection = true
+		if strings.HasPrefix(trimmed, "[[") {
+			//arrays of tables cannot be edited, so they get a name no key will match
+			info.section = trimmed
+		} else {
+			info.section = strings.TrimSpace(trimmed[1:end])
+		}
+		return
+	}
+
+	separators := "="
+	if d.format == FormatProperties {
+		separators = "=:"
+	}
+	separator := strings.IndexAny(line, separators)
+	if separator == -1 {
+		if d.format != FormatProperties {
+			return
+		}
+		//properties can separate the key with a space, or have no value at all
+		separator = strings.IndexAny(trimmed, " \t")
+		if separator == -1 {
+			return lineInfo{isKey: true, key: trimmed, valueAt: len(line)}
+		}
+		separator += strings.Index(line, trimmed)
+	}
+
+	info.isKey = true
+	info.key = strings.TrimSpace(line[:separator])
+	if d.format == FormatToml {
+		info.key = strings.Trim(info.key, `"'`)
+	}
+	info.valueAt = separator + 1
+	for info.valueAt < len(line) && (line[info.valueAt] == ' ' || line[info.valueAt] == '\t') {
+		info.valueAt++
+	}
+	return
+}
+
+//Splits a key into the section it is in and its name
+func (d *lineDocument) splitKey(key string) (string, string) {
+	if d.format == FormatProperties {
+		return "", escapeProperty(key, true)
+	}
+	if i := strings.LastIndex(key, "."); i != -1 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+func (d *lineDocument) set(key string, value interface{}) error {
+	section, name := d.splitKey(key)
+	infos := d.scan()
+
+	for i, info := range infos {
+		if info.isKey && info.section == section && info.key == name {
+			if info.multiline {
+				return errors.New("the value goes over several lines, which cannot be edited")
+			}
+			line := d.lines[i]
+			rest := line[info.valueEnd:]
+			if strings.HasPrefix(rest, "#") {
+				rest = " " + rest
+			}
+			d.lines[i] = line[:info.valueAt] + d.encode(value, strings.TrimSpace(line[info.valueAt:info.valueEnd])) + rest
+			return nil
+		}
+	}
+
+	line := name + "=" + d.encode(value, "")
+	if d.format == FormatToml {
+		if strings.ContainsAny(name, " .\"'") {
+			name = strconv.Quote(name)
+		}
+		line = name + " = " + d.encode(value, "")
+	}
+
+	//new keys go after the last key of their section
+	insertAt, found := -1, false
+	for i, info := range infos {
+		if info.isSection && info.section == section {
+			insertAt, found = i+1, true
+		} else if info.isSection && section == "" && insertAt == -1 {
+			insertAt, found = i, true
+		} else if (info.isKey || info.continued) && info.section == section {
+			insertAt, found = i+1, true
+		}
+	}
+	if section == "" && !found {
+		insertAt, found = len(d.lines), true
+	}
+
+	if !found {
+		if len(d.lines) > 0 && strings.TrimSpace(d.lines[len(d.lines)-1]) != "" {
+			d.lines = append(d.lines, "")
+		}
+		d.lines = append(d.lines, "["+section+"]", line)
+		return nil
+	}
+
+	d.lines = append(d.lines, "")
+	copy(d.lines[insertAt+1:], d.lines[insertAt:])
+	d.lines[insertAt] = line
+	return nil
+}
+
+func (d *lineDocument) delete(key string) bool {
+	section, name := d.splitKey(key)
+	infos := d.scan()
+
+	lines := make([]string, 0, len(d.lines))
+	deleting := false
+	for i, info := range infos {
+		if info.continued && deleting {
+			continue
+		}
+		deleting = info.isKey && info.section == section && info.key == name
+		if !deleting {
+			lines = append(lines, d.lines[i])
+		}
+	}
+	deleted := len(lines) != len(d.lines)
+	d.lines = lines
+	return deleted
+}
+
+func (d *lineDocument) bytes() ([]byte, error) {
+	result := strings.Join(d.lines, d.newline)
+	if d.trailing && len(d.lines) > 0 {
+		result += d.newline
+	}
+	return []byte(result), nil
+}
+
+//Writes a value the way the format expects, keeping the type of the value it replaces
+func (d *lineDocument) encode(value interface{}, existing string) string {
+	if d.format != FormatToml {
+		switch v := value.(type) {
+		case nil:
+			return ""
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = d.encode(item, "")
+			}
+			return strings.Join(items, ",")
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		if d.format == FormatProperties {
+			return escapeProperty(fmt.Sprint(value), false)
+		}
+		return fmt.Sprint(value)
+	}
+
+	switch v := value.(type) {
+	case string:
+		quoted := existing == "" || strings.ContainsAny(existing[:1], `"'[{`)
+		if !quoted && tomlBareValue.MatchString(v) {
+			return v
+		}
+		if strings.HasPrefix(existing, "'") && !strings.ContainsAny(v, "'\n") {
+			return "'" + v + "'"
+		}
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case json.Number:
+		return v.String()
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = d.encode(item, "")
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		items := make([]string, len(keys))
+		for i, k := range keys {
+			items[i] = strconv.Quote(k) + " = " + d.encode(v[k], "")
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case nil:
+		return `""`
+	}
+	return strconv.Quote(fmt.Sprint(value))
+}
+
+//Escapes a properties key or value the way java.util.Properties writes them, so they are read back as they were given.
+//Characters outside of printable ascii are written as unicode escapes.
+func escapeProperty(value string, isKey bool) string {
+	result := &strings.Builder{}
+	for i, c := range value {
+		switch c {
+		case '\\':
+			result.WriteString(`\\`)
+		case '\t':
+			result.WriteString(`\t`)
+		case '\n':
+			result.WriteString(`\n`)
+		case '\r':
+			result.WriteString(`\r`)
+		case '\f':
+			result.WriteString(`\f`)
+		case '=', ':', '#', '!':
+			result.WriteByte('\\')
+			result.WriteRune(c)
+		case ' ':
+			//spaces are only kept by escaping them in keys, or at the start of values
+			if isKey || i == 0 {
+				result.WriteByte('\\')
+			}
+			result.WriteByte(' ')
+		default:
+			if c < 0x20 || c > 0x7e {
+				for _, unit := range utf16.Encode([]rune{c}) {
+					fmt.Fprintf(result, "\\u%04X", unit)
+				}
+			} else {
+				result.WriteRune(c)
+			}
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,169 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package editfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Json files are read into objects, edited and written back out, with their keys sorted
+type treeDocument struct {
+	root interface{}
+}
+
+func parseJson(data []byte) (*treeDocument, error) {
+	doc := &treeDocument{root: make(map[string]interface{})}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return doc, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, err
+	}
+	if _, ok := root.(map[string]interface{}); !ok {
+		return nil, errors.New("the file is not an object")
+	}
+	doc.root = root
+	return doc, nil
+}
+
+func (d *treeDocument) set(key string, value interface{}) (err error) {
+	d.root, err = d.setPath(d.root, strings.Split(key, "."), value)
+	return
+}
+
+func (d *treeDocument) setPath(node interface{}, parts []string, value interface{}) (interface{}, error) {
+	existing, ok := getChild(node, parts[0])
+	if len(parts) == 1 {
+		return setChild(node, parts[0], coerce(value, existing)), nil
+	}
+
+	if !ok || existing == nil {
+		existing = make(map[string]interface{})
+	}
+	if !isObject(existing) {
+		return nil, fmt.Errorf("%s is not an object", parts[0])
+	}
+
+	child, err := d.setPath(existing, parts[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	return setChild(node, parts[0], child), nil
+}
+
+func (d *treeDocument) delete(key string) (deleted bool) {
+	d.root, deleted = deletePath(d.root, strings.Split(key, "."))
+	return
+}
+
+func deletePath(node interface{}, parts []string) (interface{}, bool) {
+	if len(parts) == 1 {
+		return deleteChild(node, parts[0])
+	}
+
+	child, ok := getChild(node, parts[0])
+	if !ok || !isObject(child) {
+		return node, false
+	}
+	child, deleted := deletePath(child, parts[1:])
+	if deleted {
+		node = setChild(node, parts[0], child)
+	}
+	return node, deleted
+}
+
+func (d *treeDocument) bytes() ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(d.root)
+	return buffer.Bytes(), err
+}
+
+func isObject(node interface{}) bool {
+	switch node.(type) {
+	case map[string]interface{}:
+		return true
+	}
+	return false
+}
+
+func getChild(node interface{}, key string) (interface{}, bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		value, ok := v[key]
+		return value, ok
+	}
+	return nil, false
+}
+
+func setChild(node interface{}, key string, value interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		v[key] = value
+		return v
+	}
+	return node
+}
+
+func deleteChild(node interface{}, key string) (interface{}, bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		_, ok := v[key]
+		delete(v, key)
+		return v, ok
+	}
+	return node, false
+}
+
+//Converts a string to the type of the value it replaces, as values from the server data are always strings
+func coerce(value interface{}, existing interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok || existing == nil {
+		return value
+	}
+
+	switch existing.(type) {
+	case json.Number:
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case int, int64, uint64:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	case float64:
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case bool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return value
+}
@@ -0,0 +1,372 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+
+package editfile
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"strconv"
+	"strings"
+)
+
+//Yaml files are edited a line at a time like properties files, so comments and formatting are kept.
+//Only keys of mappings written as blocks can be edited, keys inside lists or inline mappings are left alone.
+type yamlDocument struct {
+	*lineDocument
+}
+
+//A key of a mapping, and the lines which belong to it
+type yamlEntry struct {
+	path   string
+	line   int
+	indent int
+	//the key as written, with any quotes around it
+	key     string
+	valueAt int
+	//where the value ends, a comment after it is kept
+	valueEnd int
+	//the value is on the same line as the key, rather than below it
+	inline bool
+	//the value goes on over the lines after it
+	multiline bool
+	//the line after the last line which belongs to the key
+	end int
+}
+
+func parseYaml(data []byte) (*yamlDocument, error) {
+	//the file is read once to make sure it is a mapping, it is then only edited as text
+	root := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	return &yamlDocument{lineDocument: parseLines(data, FormatYaml)}, nil
+}
+
+func (d *yamlDocument) scan() []*yamlEntry {
+	var entries []*yamlEntry
+	var stack []*yamlEntry
+	//lines indented further than this belong to the value above them, such as a list or a string over several lines
+	skipIndent := -1
+	var skipFor *yamlEntry
+
+	for i, line := range d.lines {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if skipIndent != -1 {
+			if trimmed == "" {
+				continue
+			}
+			if indent > skipIndent {
+				if skipFor != nil {
+					skipFor.multiline = true
+				}
+				for _, e := range stack {
+					e.end = i + 1
+				}
+				continue
+			}
+			skipIndent, skipFor = -1, nil
+		}
+
+		if trimmed == "" || trimmed[0] == '#' || trimmed == "---" || trimmed == "..." || trimmed[0] == '%' {
+			continue
+		}
+
+		content := line[indent:]
+		isItem := content == "-" || strings.HasPrefix(content, "- ")
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			//a list may start at the same indent as the key it belongs to
+			if top.indent < indent || (top.indent == indent && isItem && !top.inline) {
+				break
+			}
+			stack = stack[:len(stack)-1]
+		}
+		for _, e := range stack {
+			e.end = i + 1
+		}
+
+		if isItem {
+			skipIndent = indent
+			continue
+		}
+
+		key, separator := splitYamlKey(content)
+		if separator == -1 {
+			continue
+		}
+
+		entry := &yamlEntry{line: i, indent: indent, key: key, end: i + 1}
+		entry.path = unquoteYamlKey(key)
+		if len(stack) > 0 {
+			entry.path = stack[len(stack)-1].path + "." + entry.path
+		}
+
+		entry.valueAt = indent + separator + 1
+		for entry.valueAt < len(line) && (line[entry.valueAt] == ' ' || line[entry.valueAt] == '\t') {
+			entry.valueAt++
+		}
+		entry.valueEnd = len(line)
+		if comment := findYamlComment(line, entry.valueAt); comment != -1 {
+			entry.valueEnd = len(strings.TrimRight(line[:comment], " \t"))
+			if entry.valueEnd < entry.valueAt {
+				entry.valueEnd = entry.valueAt
+			}
+		}
+
+		value := line[entry.valueAt:entry.valueEnd]
+		//anchors and tags alone leave the value below the key
+		entry.inline = value != "" && !((value[0] == '&' || value[0] == '!') && !strings.ContainsAny(value, " \t"))
+		if entry.inline {
+			skipIndent, skipFor = indent, entry
+		}
+
+		entries = append(entries, entry)
+		stack = append(stack, entry)
+	}
+	return entries
+}
+
+//Finds the key at the start of the line, and where the colon after it is, or -1 if the line has no key
+func splitYamlKey(content string) (string, int) {
+	if content[0] == '"' || content[0] == '\'' {
+		quote := content[0]
+		for i := 1; i < len(content); i++ {
+			if quote == '"' && content[i] == '\\' {
+				i++
+			} else if content[i] == quote {
+				if quote == '\'' && i+1 < len(content) && content[i+1] == '\'' {
+					i++
+					continue
+				}
+				rest := strings.TrimLeft(content[i+1:], " \t")
+				if strings.HasPrefix(rest, ":") && (len(rest) == 1 || rest[1] == ' ' || rest[1] == '\t') {
+					return content[:i+1], len(content) - len(rest)
+				}
+				return "", -1
+			}
+		}
+		return "", -1
+	}
+	if content[0] == '[' || content[0] == '{' || content[0] == '?' {
+		return "", -1
+	}
+
+	for i := 0; i < len(content); i++ {
+		if content[i] == '#' && i > 0 && (content[i-1] == ' ' || content[i-1] == '\t') {
+			return "", -1
+		}
+		if content[i] == ':' && (i+1 == len(content) || content[i+1] == ' ' || content[i+1] == '\t') {
+			return strings.TrimRight(content[:i], " \t"), i
+		}
+	}
+	return "", -1
+}
+
+func unquoteYamlKey(key string) string {
+	if strings.HasPrefix(key, `"`) {
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			return unquoted
+		}
+	} else if strings.HasPrefix(key, "'") {
+		return strings.Replace(key[1:len(key)-1], "''", "'", -1)
+	}
+	return key
+}
+
+//Gives where the comment after a value starts, or -1 if there is none
+func findYamlComment(line string, start int) int {
+	var quote byte
+	for i := start; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == start:
+			quote = c
+		case c == '#' && (i == start || line[i-1] == ' ' || line[i-1] == '\t'):
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *yamlDocument) find(entries []*yamlEntry, path string) *yamlEntry {
+	for _, e := range entries {
+		if e.path == path {
+			return e
+		}
+	}
+	return nil
+}
+
+func (d *yamlDocument) set(key string, value interface{}) error {
+	entries := d.scan()
+	parts := strings.Split(key, ".")
+
+	if entry := d.find(entries, key); entry != nil {
+		var existing interface{}
+		if entry.inline && !entry.multiline {
+			yaml.Unmarshal([]byte(d.lines[entry.line][entry.valueAt:entry.valueEnd]), &existing)
+		}
+		inline, block, err := encodeYaml(coerce(value, existing), entry.indent)
+		if err != nil {
+			return err
+		}
+
+		line := d.lines[entry.line]
+		if entry.inline && !entry.multiline && len(block) == 0 {
+			d.lines[entry.line] = line[:entry.valueAt] + inline + line[entry.valueEnd:]
+			return nil
+		}
+		if entry.multiline && isInlineCollection(line[entry.valueAt:entry.valueEnd]) {
+			return errors.New("the value goes over several lines, which cannot be edited")
+		}
+
+		lines := []string{yamlKeyLine(entry.indent, entry.key, inline) + yamlComment(line[entry.valueEnd:])}
+		d.replace(entry.line, entry.end, append(lines, block...))
+		return nil
+	}
+
+	//new keys go at the end of the deepest mapping which already exists
+	insertAt, indent, depth := len(d.lines), 0, 0
+	if len(entries) > 0 {
+		indent = entries[0].indent
+	}
+	for n := len(parts) - 1; n > 0; n-- {
+		parent := d.find(entries, strings.Join(parts[:n], "."))
+		if parent == nil {
+			continue
+		}
+		if parent.inline {
+			line := d.lines[parent.line]
+			value := line[parent.valueAt:parent.valueEnd]
+			if parent.multiline || (value != "~" && value != "null") {
+				return fmt.Errorf("%s is not an object", parts[n-1])
+			}
+			d.lines[parent.line] = yamlKeyLine(parent.indent, parent.key, "") + yamlComment(line[parent.valueEnd:])
+		}
+		insertAt, indent, depth = parent.end, parent.indent+2, n
+		for _, e := range entries {
+			if e.line > parent.line && e.line < parent.end {
+				indent = e.indent
+				break
+			}
+		}
+		break
+	}
+
+	var lines []string
+	for i, part := range parts[depth:] {
+		name := part
+		if needsYamlQuotes(name) {
+			name = strconv.Quote(name)
+		}
+		if depth+i < len(parts)-1 {
+			lines = append(lines, yamlKeyLine(indent+2*i, name, ""))
+			continue
+		}
+		inline, block, err := encodeYaml(value, indent+2*i)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, yamlKeyLine(indent+2*i, name, inline))
+		lines = append(lines, block...)
+	}
+	d.replace(insertAt, insertAt, lines)
+	return nil
+}
+
+func (d *yamlDocument) delete(key string) bool {
+	entry := d.find(d.scan(), key)
+	if entry == nil {
+		return false
+	}
+	d.replace(entry.line, entry.end, nil)
+	return true
+}
+
+//Replaces the lines from start up to end with the given lines
+func (d *yamlDocument) replace(start, end int, lines []string) {
+	result := make([]string, 0, len(d.lines)-(end-start)+len(lines))
+	result = append(result, d.lines[:start]...)
+	result = append(result, lines...)
+	d.lines = append(result, d.lines[end:]...)
+}
+
+//Keeps a comment apart from the value before it
+func yamlComment(rest string) string {
+	if strings.HasPrefix(rest, "#") {
+		return " " + rest
+	}
+	return rest
+}
+
+func yamlKeyLine(indent int, key, value string) string {
+	line := strings.Repeat(" ", indent) + key + ":"
+	if value != "" {
+		line += " " + value
+	}
+	return line
+}
+
+//Writes a value for a key at the given indent, giving what goes after the key and the lines below it.
+//Mappings and lists go below the key, other values after it.
+func encodeYaml(value interface{}, indent int) (string, []string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	first := lines[0]
+	_, separator := splitYamlKey(first)
+	if strings.HasPrefix(first, "- ") || first == "-" || separator != -1 {
+		block := make([]string, len(lines))
+		for i, line := range lines {
+			block[i] = strings.Repeat(" ", indent+2) + line
+		}
+		return "", block, nil
+	}
+
+	//strings over several lines are written as a block scalar, which is already indented below the key
+	block := lines[1:]
+	for i, line := range block {
+		if line != "" {
+			block[i] = strings.Repeat(" ", indent) + line
+		}
+	}
+	return first, block, nil
+}
+
+func isInlineCollection(value string) bool {
+	return strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{")
+}
+
+func needsYamlQuotes(key string) bool {
+	if key == "" || strings.ContainsAny(key[:1], "-?:,[]{}#&*!|>'\"%@` ") {
+		return true
+	}
+	return strings.Contains(key, ": ") || strings.Contains(key, " #") || strings.HasSuffix(key, ":")
+}
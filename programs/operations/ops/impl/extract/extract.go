@@ -0,0 +1,239 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/programs/operations/ops"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//longest symlink target read from a zip, which is more than any real path needs
+const maxSymlinkSize = 4096
+
+type Extract struct {
+	Source  string
+	Target  string
+	Format  string
+	Include []string
+	Exclude []string
+	Strip   int
+}
+
+func (e Extract) Run(env environments.Environment) error {
+	root, err := filepath.Abs(env.GetRootDirectory())
+	if err != nil {
+		return err
+	}
+
+	source, err := commons.ResolvePath(root, e.Source)
+	if err != nil {
+		return err
+	}
+	target, err := commons.ResolvePath(root, e.Target)
+	if err != nil {
+		return err
+	}
+
+	format := e.Format
+	if format == "" {
+		format = commons.GetArchiveFormat(source)
+	}
+
+	logging.Debugf("Extracting %s to %s as %s", source, target, format)
+	env.DisplayToConsole("Extracting %s\n", e.Source)
+
+	err = os.MkdirAll(target, 0755)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	switch format {
+	case commons.ArchiveZip:
+		count, err = e.extractZip(root, source, target)
+	case commons.ArchiveTar, commons.ArchiveTarGz, commons.ArchiveTarXz:
+		count, err = e.extractTar(root, source, target, format)
+	default:
+		return fmt.Errorf("unknown archive format for %s", e.Source)
+	}
+	if err != nil {
+		return err
+	}
+
+	env.DisplayToConsole("Extracted %d files from %s\n", count, e.Source)
+	return nil
+}
+
+func (e Extract) extractZip(root, source, target string) (count int, err error) {
+	archive, err := zip.OpenReader(source)
+	if err != nil {
+		return
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		info := file.FileInfo()
+		item := commons.ArchiveEntry{Name: file.Name, Mode: info.Mode(), ModTime: file.Modified}
+
+		var reader io.ReadCloser
+		if !info.IsDir() {
+			reader, err = file.Open()
+			if err != nil {
+				return
+			}
+		}
+
+		var written bool
+		if info.Mode()&os.ModeSymlink != 0 {
+			//zip stores the target of a symlink as its contents, and the size in the header cannot be trusted
+			var link []byte
+			link, err = ioutil.ReadAll(io.LimitReader(reader, maxSymlinkSize+1))
+			if err == nil && len(link) > maxSymlinkSize {
+				err = fmt.Errorf("symlink %s is too long", file.Name)
+			}
+			if err == nil {
+				item.Link = string(link)
+				written, err = e.write(root, target, item, nil)
+			}
+		} else {
+			written, err = e.write(root, target, item, reader)
+		}
+		if reader != nil {
+			reader.Close()
+		}
+		if err != nil {
+			return
+		}
+		if written {
+			count++
+		}
+	}
+	return
+}
+
+func (e Extract) extractTar(root, source, target, format string) (count int, err error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	switch format {
+	case commons.ArchiveTarGz:
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		reader = gz
+	case commons.ArchiveTarXz:
+		reader, err = xz.NewReader(file)
+		if err != nil {
+			return
+		}
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		item := commons.ArchiveEntry{Name: header.Name, Mode: header.FileInfo().Mode(), ModTime: header.ModTime}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeRegA:
+		case tar.TypeSymlink:
+			item.Link = header.Linkname
+		default:
+			logging.Debugf("Skipping %s in %s, it is not a file, folder or symlink", header.Name, source)
+			continue
+		}
+
+		written, err := e.write(root, target, item, tr)
+		if err != nil {
+			return count, err
+		}
+		if written {
+			count++
+		}
+	}
+}
+
+//Writes the entry into the target folder, unless it is filtered out or nothing is left of its name after stripping
+func (e Extract) write(root, target string, item commons.ArchiveEntry, data io.Reader) (bool, error) {
+	name := commons.CleanArchiveName(item.Name, e.Strip)
+	if name == "" || !commons.MatchArchiveName(name, e.Include, e.Exclude) {
+		return false, nil
+	}
+
+	relative, err := filepath.Rel(root, filepath.Join(target, filepath.FromSlash(name)))
+	if err != nil {
+		return false, err
+	}
+	item.Name = filepath.ToSlash(relative)
+	if err = commons.WriteArchiveEntry(root, item, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type ExtractOperationFactory struct {
+}
+
+func (of ExtractOperationFactory) Create(op ops.CreateOperation) ops.Operation {
+	source := common.GetStringOrDefault(op.OperationArgs, "source", "")
+	target := common.GetStringOrDefault(op.OperationArgs, "target", ".")
+	format := common.GetStringOrDefault(op.OperationArgs, "format", "")
+	include := common.ToStringArray(op.OperationArgs["include"])
+	exclude := common.ToStringArray(op.OperationArgs["exclude"])
+
+	strip := 0
+	switch v := op.OperationArgs["strip"].(type) {
+	case float64:
+		strip = int(v)
+	case int:
+		strip = v
+	case string:
+		strip, _ = strconv.Atoi(v)
+	}
+
+	return Extract{Source: source, Target: target, Format: format, Include: include, Exclude: exclude, Strip: strip}
+}
+
+func (of ExtractOperationFactory) Key() string {
+	return "extract"
+}
+
+var Factory ExtractOperationFactory
@@ -100,7 +100,7 @@ func downloadServerFromJson(url, target string, env environments.Environment) er
 	logging.Debugf("Version jar located, downloading from %s", serverBlock.Url)
 	env.DisplayToConsole(fmt.Sprintf("Version jar located, downloading from %s\n", serverBlock.Url))
 
-	return commons.DownloadFile(serverBlock.Url, target, env)
+	return commons.DownloadFile(serverBlock.Url, target, commons.Checksum{Type: "sha1", Value: serverBlock.Sha1}, env)
 }
 
 type MojangDlOperationFactory struct {
@@ -0,0 +1,95 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package replace
+
+import (
+	"fmt"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/programs/operations/ops"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+//Replaces everything matching the pattern in a file.
+//The replacement can use $1 or $name for groups, ${1} has to be written as $${1} so it is not taken as a variable.
+type Replace struct {
+	Target      string
+	Pattern     string
+	Replacement string
+	Literal     bool
+}
+
+func (r Replace) Run(env environments.Environment) error {
+	target, err := commons.ResolvePath(env.GetRootDirectory(), r.Target)
+	if err != nil {
+		return err
+	}
+
+	pattern := r.Pattern
+	if r.Literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	expr, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %s: %s", r.Pattern, err.Error())
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		return err
+	}
+
+	logging.Debugf("Replacing %s in %s", pattern, target)
+	count := len(expr.FindAllIndex(data, -1))
+	env.DisplayToConsole("Replacing %d matches in %s\n", count, r.Target)
+	if count == 0 {
+		return nil
+	}
+
+	var result []byte
+	if r.Literal {
+		result = expr.ReplaceAllLiteral(data, []byte(r.Replacement))
+	} else {
+		result = expr.ReplaceAll(data, []byte(r.Replacement))
+	}
+	return ioutil.WriteFile(target, result, info.Mode())
+}
+
+type ReplaceOperationFactory struct {
+}
+
+func (of ReplaceOperationFactory) Create(op ops.CreateOperation) ops.Operation {
+	target := common.GetStringOrDefault(op.OperationArgs, "target", "")
+	pattern := common.GetStringOrDefault(op.OperationArgs, "pattern", "")
+	replacement := common.GetStringOrDefault(op.OperationArgs, "replacement", "")
+	literal, _ := op.OperationArgs["literal"].(bool)
+	return Replace{Target: target, Pattern: pattern, Replacement: replacement, Literal: literal}
+}
+
+func (of ReplaceOperationFactory) Key() string {
+	return "replace"
+}
+
+var Factory ReplaceOperationFactory
@@ -54,7 +54,8 @@ type dependencies struct {
 }
 
 type artifact struct {
-	Url string `json:"url"`
+	Url  string `json:"url"`
+	Sha1 string `json:"sha1"`
 }
 
 func (op SpongeForgeDl) Run(env environments.Environment) error {
@@ -107,7 +108,7 @@ func (op SpongeForgeDl) Run(env environments.Environment) error {
 	versionMapping["forge"] = versionData.Dependencies.Forge
 	versionMapping["minecraft"] = versionData.Dependencies.Minecraft
 
-	err := commons.DownloadFile(common.ReplaceTokens(FORGE_URL, versionMapping), "forge-installer.jar", env)
+	err := commons.DownloadFile(common.ReplaceTokens(FORGE_URL, versionMapping), "forge-installer.jar", commons.Checksum{}, env)
 	if err != nil {
 		return err
 	}
@@ -117,7 +118,8 @@ func (op SpongeForgeDl) Run(env environments.Environment) error {
 		return err
 	}
 
-	err = commons.DownloadFile(versionData.Artifacts[""].Url, path.Join("mods", "spongeforge.jar"), env)
+	mod := versionData.Artifacts[""]
+	err = commons.DownloadFile(mod.Url, path.Join("mods", "spongeforge.jar"), commons.Checksum{Type: "sha1", Value: mod.Sha1}, env)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,287 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package operations
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/apufferi/config"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/programs/operations/ops"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Operation plugins are programs in the modules/operations folder, which talk to the daemon with json over stdio.
+//
+//Started with the describe argument, a plugin writes {"keys": ["name"]} to stdout with the operation types it provides.
+//
+//Started with the run argument in the server folder, a plugin reads one request from stdin:
+//{"key": "name", "args": {...}, "env": {...}, "data": {...}, "rootDirectory": "..."}
+//and writes one message per line to stdout while it runs:
+//{"type": "console", "message": "..."} to show on the server console, and
+//{"type": "result", "success": true, "error": "..."} once it is done.
+//Anything written to stderr goes to the daemon log.
+//
+//Operations are run by the environment of the server, as the user the server runs as and with its environment variables,
+//resource limits and sandbox. Docker servers cannot use plugins, as they would run on the host outside of the container.
+//A plugin which runs longer than operationModuleTimeout seconds, an hour by default, is killed.
+//Describing runs as the daemon user, so only the owner of a plugin may be able to change it.
+const pluginDescribeTimeout = 10 * time.Second
+
+type pluginDescription struct {
+	Keys []string `json:"keys"`
+}
+
+type pluginRequest struct {
+	Key           string                 `json:"key"`
+	Args          map[string]interface{} `json:"args"`
+	Env           map[string]string      `json:"env"`
+	Data          map[string]interface{} `json:"data"`
+	RootDirectory string                 `json:"rootDirectory"`
+}
+
+type pluginMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+	Success bool   `json:"success,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type pluginOperationFactory struct {
+	program string
+	key     string
+}
+
+func (of pluginOperationFactory) Create(op ops.CreateOperation) ops.Operation {
+	return pluginOperation{program: of.program, request: pluginRequest{
+		Key:  of.key,
+		Args: op.OperationArgs,
+		Env:  op.EnvironmentVariables,
+		Data: op.DataMap,
+	}}
+}
+
+func (of pluginOperationFactory) Key() string {
+	return of.key
+}
+
+type pluginOperation struct {
+	program string
+	request pluginRequest
+}
+
+func (op pluginOperation) Run(env environments.Environment) (err error) {
+	request := op.request
+	request.RootDirectory = env.GetRootDirectory()
+	data, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.GetIntOrDefault("operationModuleTimeout", 3600))*time.Second)
+	defer cancel()
+
+	//output goes through a pipe the daemon closes once the plugin is done, so none of it is lost to the plugin exiting
+	reader, writer := io.Pipe()
+	cmd := exec.Command(op.program, "run")
+	cmd.Dir = env.GetRootDirectory()
+	cmd.Stdin = strings.NewReader(string(data) + "\n")
+	cmd.Stdout = writer
+	cmd.Stderr = pluginLogWriter{key: request.Key}
+
+	logging.Debugf("Running operation %s with plugin %s", request.Key, op.program)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- env.RunCommand(ctx, cmd)
+		writer.Close()
+	}()
+
+	//a cancelled job stops the plugin, rather than waiting for it to finish
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+				if job := env.GetJob(); job != nil && job.Cancelled() {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	var result *pluginMessage
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		msg := pluginMessage{}
+		if jErr := json.Unmarshal([]byte(line), &msg); jErr != nil {
+			//anything which is not a message is shown as it is
+			env.DisplayToConsole("%s\n", line)
+			continue
+		}
+
+		switch msg.Type {
+		case "console":
+			if !strings.HasSuffix(msg.Message, "\n") {
+				msg.Message += "\n"
+			}
+			env.DisplayToConsole("%s", msg.Message)
+		case "result":
+			result = &msg
+		default:
+			logging.Debugf("Unknown message type %s from plugin %s", msg.Type, op.program)
+		}
+	}
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		//nothing reads what the plugin writes from here on, so it is stopped rather than left blocked
+		cancel()
+		io.Copy(ioutil.Discard, reader)
+	}
+
+	err = <-exited
+	if job := env.GetJob(); job != nil && job.Cancelled() {
+		return environments.ErrCancelled
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("operation %s timed out", request.Key)
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	if result == nil {
+		if err != nil {
+			return fmt.Errorf("operation %s failed: %s", request.Key, err.Error())
+		}
+		return fmt.Errorf("operation %s did not report a result", request.Key)
+	}
+	if !result.Success {
+		if result.Error == "" {
+			result.Error = "operation " + request.Key + " failed"
+		}
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+//Writes what a plugin logs to the daemon log, a line at a time
+type pluginLogWriter struct {
+	key string
+}
+
+func (w pluginLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		logging.Infof("[%s] %s", w.key, line)
+	}
+	return len(p), nil
+}
+
+func loadOpModules() {
+	var directory = path.Join(config.GetStringOrDefault("dataFolder", ""), "modules", "operations")
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil && os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logging.Error("Error reading directory", err)
+		return
+	}
+
+	wait := sync.WaitGroup{}
+	locker := sync.Mutex{}
+	for _, file := range files {
+		if file.IsDir() || (runtime.GOOS != "windows" && file.Mode()&0111 == 0) {
+			continue
+		}
+		if runtime.GOOS != "windows" && file.Mode()&0022 != 0 {
+			logging.Errorf("Module %s can be changed by other users, not loading it", file.Name())
+			continue
+		}
+
+		wait.Add(1)
+		go func(program string) {
+			defer wait.Done()
+			logging.Infof("Loading operation module: %s", program)
+			keys, err := describePlugin(program)
+			if err != nil {
+				logging.Error("Unable to load module "+program, err)
+				return
+			}
+
+			locker.Lock()
+			defer locker.Unlock()
+			for _, key := range keys {
+				if _, ok := controlMapping[key]; ok {
+					logging.Errorf("Module %s cannot replace the %s operation", program, key)
+					continue
+				}
+				if existing, ok := commandMapping[key]; ok {
+					logging.Warnf("Module %s replaces the %s operation from %v", program, key, existing)
+				}
+				commandMapping[key] = pluginOperationFactory{program: program, key: key}
+				logging.Infof("Loaded operation module: %s", key)
+			}
+		}(path.Join(directory, file.Name()))
+	}
+	wait.Wait()
+}
+
+//Asks the plugin which operations it provides
+func describePlugin(program string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDescribeTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, program, "describe")
+	cmd.Stderr = pluginLogWriter{key: path.Base(program)}
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	description := pluginDescription{}
+	err = json.Unmarshal(output, &description)
+	if err != nil {
+		return nil, fmt.Errorf("invalid description: %s", err.Error())
+	}
+	if len(description.Keys) == 0 {
+		return nil, errors.New("module provides no operations")
+	}
+	return description.Keys, nil
+}
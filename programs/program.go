@@ -19,6 +19,7 @@ package programs
 import (
 	"container/list"
 	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/messages"
 	"sync"
 	"time"
 )
@@ -32,6 +33,10 @@ type Program interface {
 	//This will also stop the environment it is ran in.
 	Stop() (err error)
 
+	//Stops the program and waits for it to exit, killing it if it does not stop in time.
+	//Graceful is false if it had to be killed.
+	StopAndWait() (graceful bool, err error)
+
 	//Kills the program.
 	//This will also stop the environment it is ran in.
 	Kill() (err error)
@@ -44,8 +49,25 @@ type Program interface {
 	//This will delete the server, environment, and any files related to it.
 	Destroy() (err error)
 
+	//Installs the program, waiting for it to finish.
 	Install() (err error)
 
+	//Starts installing the program in the background.
+	InstallJob() (*Job, error)
+
+	//Starts running the uninstall operations of the program in the background.
+	UninstallJob() (*Job, error)
+
+	//Gets the running job of the program and those which have finished, newest first.
+	GetJobs() ([]messages.JobMessage, error)
+
+	GetJob(id string) (messages.JobMessage, error)
+
+	//Gets the path to the log of a job.
+	GetJobLog(id string) (string, error)
+
+	CancelJob(id string) error
+
 	//Determines if the server is running.
 	IsRunning() (isRunning bool, err error)
 
@@ -67,6 +89,11 @@ type Program interface {
 
 	GetEnvironment() environments.Environment
 
+	//Gets the name of the template the program was created from.
+	GetTemplate() string
+
+	GetBackupSettings() BackupSection
+
 	Save(file string) (err error)
 
 	Edit(data map[string]interface{}) (err error)
@@ -74,6 +101,32 @@ type Program interface {
 	GetData() map[string]DataObject
 
 	GetNetwork() string
+
+	//Gets where the program is in its lifecycle.
+	GetState() State
+
+	//Attaches to the program if it is still running from a previous run of the daemon.
+	Reattach() (attached bool, err error)
+
+	//Updates the resource limits of the server.
+	//This is applied to the environment immediately and saved with the server.
+	SetResourceLimits(data map[string]interface{}) (err error)
+
+	//Starts running the schedules of the program, replacing any which were running.
+	StartScheduler()
+
+	StopScheduler()
+
+	//Gets the schedules of the program along with when they last and next run.
+	GetSchedules() map[string]ScheduleInfo
+
+	//Adds or replaces a schedule and saves the program.
+	SetSchedule(name string, schedule Schedule) (err error)
+
+	DeleteSchedule(name string) (err error)
+
+	//Runs a schedule now, without waiting for it to finish.
+	RunSchedule(name string) (err error)
 }
 
 var queue *list.List
@@ -107,6 +160,10 @@ func ShutdownService() {
 
 	running = false
 	ticker.Stop()
+
+	for _, v := range allPrograms {
+		v.StopScheduler()
+	}
 }
 
 func processQueue() {
@@ -19,13 +19,19 @@ package programs
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/pufferpanel/apufferi/common"
 	"github.com/pufferpanel/apufferi/config"
 	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/commons"
+	"github.com/pufferpanel/pufferd/consolelog"
 	"github.com/pufferpanel/pufferd/environments"
 	"github.com/pufferpanel/pufferd/programs/operations"
+	"github.com/robfig/cron"
 	"io/ioutil"
 	"os"
+	"sync"
+	"time"
 )
 
 type ServerJson struct {
@@ -42,9 +48,19 @@ type ProgramData struct {
 	Identifier      string                 `json:"id,omitempty"`
 	RunData         RunObject              `json:"run,omitempty"`
 	Template        string                 `json:"template,omitempty"`
+	Schedules       map[string]*Schedule   `json:"schedules,omitempty"`
+	BackupData      BackupSection          `json:"backup,omitempty"`
 
 	Environment  environments.Environment `json:"-"`
 	CrashCounter int                      `json:"-"`
+
+	state               State
+	stateBeforeDownload State
+	stateLocker         *sync.Mutex
+	scheduler           *cron.Cron
+	scheduleLocker      *sync.Mutex
+	job                 *Job
+	jobLocker           *sync.Mutex
 }
 
 type DataObject struct {
@@ -68,6 +84,24 @@ type RunObject struct {
 	Post                    []map[string]interface{} `json:"post,omitempty"`
 	StopCode                int                      `json:"stopCode,omitempty"`
 	EnvironmentVariables    map[string]string        `json:"environmentVars,omitempty"`
+	Ports                   []string                 `json:"ports,omitempty"`
+	StopTimeout             int                      `json:"stopTimeout,omitempty"`
+}
+
+//Retention and preparation settings for backups of the server
+type BackupSection struct {
+	//Number of backups to keep
+	Keep int `json:"keep,omitempty"`
+	//Days after which backups are removed
+	MaxAgeDays int `json:"maxAgeDays,omitempty"`
+	//Total size in bytes all backups may use
+	MaxSize int64 `json:"maxSize,omitempty"`
+	//Stops the server while it is backed up
+	Stop bool `json:"stop,omitempty"`
+	//Console command sent before the backup so everything is written to disk
+	SaveCommand string `json:"saveCommand,omitempty"`
+	//Stores backups as snapshots which share unchanged data with earlier ones
+	Incremental bool `json:"incremental,omitempty"`
 }
 
 type InstallSection struct {
@@ -101,6 +135,9 @@ func CreateProgram() ProgramData {
 		InstallData: InstallSection{
 			Operations: make([]map[string]interface{}, 0),
 		},
+		stateLocker:    &sync.Mutex{},
+		scheduleLocker: &sync.Mutex{},
+		jobLocker:      &sync.Mutex{},
 	}
 }
 
@@ -111,6 +148,11 @@ func (p *ProgramData) Start() (err error) {
 		logging.Errorf("Server %s is not enabled, cannot start", p.Id())
 		return errors.New("server not enabled")
 	}
+	err = p.setState(StateStarting)
+	if err != nil {
+		return
+	}
+
 	logging.Debugf("Starting server %s", p.Id())
 	p.Environment.DisplayToConsole("Starting server\n")
 	data := make(map[string]interface{})
@@ -118,28 +160,66 @@ func (p *ProgramData) Start() (err error) {
 		data[k] = v.Value
 	}
 
-	process := operations.GenerateProcess(p.RunData.Pre, p.Environment, p.DataToMap(), p.RunData.EnvironmentVariables)
-	err = process.Run(p.Environment)
+	process, err := operations.GenerateProcess(p.RunData.Pre, p.Environment, p.DataToMap(), p.RunData.EnvironmentVariables)
+	if err == nil {
+		err = process.Run(p.Environment)
+	} else {
+		logging.Error("Error reading pre execute steps of server "+p.Id(), err)
+	}
 	if err != nil {
 		p.Environment.DisplayToConsole("Error running pre execute, check daemon logs\n")
+		p.setState(StateErrored)
 		return
 	}
 
 	//HACK: add rootDir stuff
 	data["rootDir"] = p.Environment.GetRootDirectory()
 
-	err = p.Environment.ExecuteAsync(p.RunData.Program, common.ReplaceTokensInArr(p.RunData.Arguments, data), common.ReplaceTokensInMap(p.RunData.EnvironmentVariables, data), p.afterExit)
+	p.Environment.SetPorts(p.getPorts(data))
+
+	args, err := commons.ReplaceTokensInArr(p.RunData.Arguments, data)
+	if err != nil {
+		logging.Error("Error reading arguments of server "+p.Id(), err)
+		p.Environment.DisplayToConsole("Invalid arguments: %s\n", err.Error())
+		p.setState(StateErrored)
+		return
+	}
+	env, err := commons.ReplaceTokensInMap(p.RunData.EnvironmentVariables, data)
+	if err != nil {
+		logging.Error("Error reading environment variables of server "+p.Id(), err)
+		p.Environment.DisplayToConsole("Invalid environment variable %s\n", err.Error())
+		p.setState(StateErrored)
+		return
+	}
+
+	//a stop asked for while the pre execute steps ran means the server is not started at all
+	if p.compareAndSetState(StateStopping, StateStopped) {
+		p.Environment.DisplayToConsole("Server stopped before it started\n")
+		return
+	}
+
+	err = p.Environment.ExecuteAsync(p.RunData.Program, args, env, p.afterExit)
 	if err != nil {
 		logging.Error("Error starting server", err)
 		p.Environment.DisplayToConsole("Failed to start server\n")
+		p.setState(StateErrored)
+		return
 	}
 
+	//the server may have already exited, in which case it has moved on from starting
+	p.compareAndSetState(StateStarting, StateRunning)
 	return
 }
 
 //Stops the program.
 //This will also stop the environment it is ran in.
 func (p *ProgramData) Stop() (err error) {
+	previous := p.GetState()
+	err = p.setState(StateStopping)
+	if err != nil {
+		return
+	}
+
 	logging.Debugf("Stopping server %s", p.Id())
 	if p.RunData.StopCode != 0 {
 		err = p.Environment.SendCode(p.RunData.StopCode)
@@ -148,19 +228,67 @@ func (p *ProgramData) Stop() (err error) {
 	}
 	if err != nil {
 		p.Environment.DisplayToConsole("Failed to stop server\n")
+		//the server is still running, unless it exited in the meantime
+		if previous != StateStopping {
+			p.compareAndSetState(StateStopping, previous)
+		}
 	} else {
+		p.Environment.DisplayToConsole("Stopping server\n")
+	}
+	return
+}
+
+//Stops the program and waits for it to exit.
+//If it is still running once the stop timeout passes, it is killed.
+func (p *ProgramData) StopAndWait() (graceful bool, err error) {
+	err = p.Stop()
+	if err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Environment.WaitForMainProcess()
+	}()
+
+	timeout := p.GetStopTimeout()
+	select {
+	case err = <-done:
+		graceful = true
 		p.Environment.DisplayToConsole("Server stopped\n")
+	case <-time.After(time.Duration(timeout) * time.Second):
+		logging.Warnf("Server %s did not stop within %d seconds, killing", p.Id(), timeout)
+		p.Environment.DisplayToConsole("Server did not stop within %d seconds, killing\n", timeout)
+		err = p.Kill()
+		if err != nil {
+			return
+		}
+		err = <-done
 	}
 	return
 }
 
+//Gets how many seconds the program has to stop before it is killed
+func (p *ProgramData) GetStopTimeout() int {
+	if p.RunData.StopTimeout > 0 {
+		return p.RunData.StopTimeout
+	}
+	return config.GetIntOrDefault("stopTimeout", 60)
+}
+
 //Kills the program.
 //This will also stop the environment it is ran in.
 func (p *ProgramData) Kill() (err error) {
 	logging.Debugf("Killing server %s", p.Id())
+	//the exit is expected, so it is not treated as a crash
+	previous := p.GetState()
+	changed := previous != StateStopping && p.setState(StateStopping) == nil
 	err = p.Environment.Kill()
 	if err != nil {
 		p.Environment.DisplayToConsole("Failed to kill server\n")
+		if changed {
+			p.compareAndSetState(StateStopping, previous)
+		}
 	} else {
 		p.Environment.DisplayToConsole("Server killed\n")
 	}
@@ -182,22 +310,83 @@ func (p *ProgramData) Create() (err error) {
 //This will delete the server, environment, and any files related to it.
 func (p *ProgramData) Destroy() (err error) {
 	logging.Debugf("Destroying server %s", p.Id())
-	process := operations.GenerateProcess(p.UninstallData.Operations, p.Environment, p.DataToMap(), p.RunData.EnvironmentVariables)
-	err = process.Run(p.Environment)
+
+	//a running install would keep writing files which are about to be removed
+	p.jobLocker.Lock()
+	current := p.job
+	p.jobLocker.Unlock()
+	if current != nil && current.GetStatus().Status == JobRunning {
+		current.Cancel()
+		current.Wait()
+	}
+
+	job, err := p.UninstallJob()
+	if err == nil {
+		err = job.Wait()
+	}
 	if err != nil {
-		p.Environment.DisplayToConsole("Error running uninstall, check daemon logs\n")
 		return
 	}
 	err = p.Environment.Delete()
+	if err != nil {
+		return
+	}
+	err = os.RemoveAll(getJobFolder(p.Id()))
+	if err != nil {
+		return
+	}
+	return consolelog.Delete(ServerFolder, p.Id())
+}
+
+//Runs the uninstall operations in the background
+func (p *ProgramData) UninstallJob() (*Job, error) {
+	return p.startJob(JobUninstall, p.uninstall)
+}
+
+func (p *ProgramData) uninstall(job *Job) (err error) {
+	running, err := p.IsRunning()
+	if err == nil && running {
+		_, err = p.StopAndWait()
+	}
+	if err != nil {
+		logging.Error("Error stopping server to uninstall: ", err)
+		p.Environment.DisplayToConsole("Error stopping server\n")
+		return
+	}
+
+	process, err := operations.GenerateProcess(p.UninstallData.Operations, p.Environment, p.DataToMap(), p.RunData.EnvironmentVariables)
+	if err == nil {
+		err = p.runJobOperations(job, process)
+	} else {
+		logging.Error("Error reading uninstall steps of server "+p.Id(), err)
+	}
+	if err == environments.ErrCancelled {
+		p.Environment.DisplayToConsole("Uninstall cancelled\n")
+	} else if err != nil {
+		p.Environment.DisplayToConsole("Error running uninstall, check daemon logs\n")
+	}
 	return
 }
 
+//Installs the server and waits for it to finish
 func (p *ProgramData) Install() (err error) {
+	job, err := p.InstallJob()
+	if err != nil {
+		return
+	}
+	return job.Wait()
+}
+
+//Starts installing the server in the background
+func (p *ProgramData) InstallJob() (*Job, error) {
 	if !p.IsEnabled() {
 		logging.Errorf("Server %s is not enabled, cannot install", p.Id())
-		return errors.New("server not enabled")
+		return nil, errors.New("server not enabled")
 	}
+	return p.startJob(JobInstall, p.install)
+}
 
+func (p *ProgramData) install(job *Job) (err error) {
 	logging.Debugf("Installing server %s", p.Id())
 	running, err := p.IsRunning()
 	if err != nil {
@@ -207,7 +396,7 @@ func (p *ProgramData) Install() (err error) {
 	}
 
 	if running {
-		err = p.Stop()
+		_, err = p.StopAndWait()
 	}
 
 	if err != nil {
@@ -216,11 +405,23 @@ func (p *ProgramData) Install() (err error) {
 		return
 	}
 
+	err = p.setState(StateInstalling)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			p.setState(StateErrored)
+		} else {
+			p.setState(StateStopped)
+		}
+	}()
+
 	p.Environment.DisplayToConsole("Installing server\n")
 
 	os.MkdirAll(p.Environment.GetRootDirectory(), 0755)
 
-	var process operations.OperationProcess
+	operationList := p.InstallData.Operations
 
 	if len(p.InstallData.Operations) == 0 && p.Template != "" {
 		logging.Debugf("Server %s has no defined install data, using template", p.Id())
@@ -239,16 +440,29 @@ func (p *ProgramData) Install() (err error) {
 			return err
 		}
 
-		process = operations.GenerateProcess(templateJson.ProgramData.InstallData.Operations, p.GetEnvironment(), p.DataToMap(), p.RunData.EnvironmentVariables)
-
+		operationList = templateJson.ProgramData.InstallData.Operations
 	} else {
 		logging.Debugf("Server %s has defined install data", p.Id())
-		process = operations.GenerateProcess(p.InstallData.Operations, p.GetEnvironment(), p.DataToMap(), p.RunData.EnvironmentVariables)
 	}
 
-	err = process.Run(p.Environment)
-	if err != nil {
+	process, err := operations.GenerateProcess(operationList, p.GetEnvironment(), p.DataToMap(), p.RunData.EnvironmentVariables)
+	if err == nil {
+		err = p.runJobOperations(job, process)
+	} else {
+		logging.Error("Error reading install steps of server "+p.Id(), err)
+	}
+	if err == environments.ErrCancelled {
+		p.Environment.DisplayToConsole("Install cancelled\n")
+		return
+	} else if err != nil {
 		p.Environment.DisplayToConsole("Error running installer, check daemon logs\n")
+		return
+	}
+
+	err = p.Environment.ResetOwnership()
+	if err != nil {
+		logging.Error("Error setting ownership of server files", err)
+		p.Environment.DisplayToConsole("Error setting ownership of server files\n")
 	} else {
 		p.Environment.DisplayToConsole("Server installed\n")
 	}
@@ -261,6 +475,27 @@ func (p *ProgramData) IsRunning() (isRunning bool, err error) {
 	return
 }
 
+//Attaches to the program if it is still running from a previous run of the daemon.
+//It counts as starting while attaching, the same as when starting it, so it exiting meanwhile is not overtaken.
+func (p *ProgramData) Reattach() (attached bool, err error) {
+	previous := p.GetState()
+	err = p.setState(StateStarting)
+	if err != nil {
+		return
+	}
+
+	attached, err = p.Environment.Reattach(p.afterExit)
+	if !attached {
+		p.compareAndSetState(StateStarting, previous)
+		return
+	}
+
+	p.compareAndSetState(StateStarting, StateRunning)
+	logging.Infof("Reattached to running server %s", p.Id())
+	p.Environment.DisplayToConsole("Reattached to running server\n")
+	return
+}
+
 //Sends a command to the process
 //If the program supports input, this will send the arguments to that.
 func (p *ProgramData) Execute(command string) (err error) {
@@ -287,6 +522,14 @@ func (p *ProgramData) Id() string {
 	return p.Identifier
 }
 
+func (p *ProgramData) GetTemplate() string {
+	return p.Template
+}
+
+func (p *ProgramData) GetBackupSettings() BackupSection {
+	return p.BackupData
+}
+
 func (p *ProgramData) GetEnvironment() environments.Environment {
 	return p.Environment
 }
@@ -346,17 +589,69 @@ func (p *ProgramData) GetNetwork() string {
 	ip := "0.0.0.0"
 	port := "0"
 
-	if ipData, ok := data["ip"]; ok {
-		ip = ipData.Value.(string)
+	if ipData, ok := data["ip"]; ok && ipData.Value != nil {
+		ip = fmt.Sprintf("%v", ipData.Value)
 	}
 
-	if portData, ok := data["port"]; ok {
-		port = portData.Value.(string)
+	if portData, ok := data["port"]; ok && portData.Value != nil {
+		port = fmt.Sprintf("%v", portData.Value)
 	}
 
 	return ip + ":" + port
 }
 
+func (p *ProgramData) SetResourceLimits(data map[string]interface{}) (err error) {
+	section := make(map[string]interface{})
+	for k, v := range p.EnvironmentData {
+		section[k] = v
+	}
+
+	for _, k := range environments.ResourceKeys {
+		if v, ok := data[k]; ok {
+			if v == nil || v == "" {
+				delete(section, k)
+			} else {
+				section[k] = v
+			}
+		}
+	}
+
+	limits, err := environments.ParseResourceLimits(section)
+	if err != nil {
+		return
+	}
+
+	err = p.Environment.SetResourceLimits(limits)
+	if err != nil {
+		return
+	}
+
+	p.EnvironmentData = section
+	err = Save(p.Id())
+	return
+}
+
+//Gets the ports the server listens on, which is the main ip and port plus any additional ports from the template
+func (p *ProgramData) getPorts(data map[string]interface{}) []string {
+	ports := make([]string, 0)
+
+	if _, ok := p.Data["port"]; ok {
+		network := p.GetNetwork()
+		ports = append(ports, network+"/tcp", network+"/udp")
+	}
+
+	replaced, err := commons.ReplaceTokensInArr(p.RunData.Ports, data)
+	if err != nil {
+		logging.Error("Error reading ports of server "+p.Id(), err)
+	}
+	for _, v := range replaced {
+		if v != "" {
+			ports = append(ports, v)
+		}
+	}
+	return ports
+}
+
 func (p *ProgramData) CopyFrom(s *ProgramData) {
 	p.Data = s.Data
 	p.RunData = s.RunData
@@ -365,6 +660,8 @@ func (p *ProgramData) CopyFrom(s *ProgramData) {
 	p.InstallData = s.InstallData
 	p.Type = s.Type
 	p.Template = s.Template
+	p.Schedules = s.Schedules
+	p.BackupData = s.BackupData
 }
 
 func (p *ProgramData) afterExit(graceful bool) {
@@ -372,22 +669,35 @@ func (p *ProgramData) afterExit(graceful bool) {
 		p.CrashCounter = 0
 	}
 
+	//a server which was asked to stop is not started again, even if it had to be killed
+	stopping := p.GetState() == StateStopping
+	if graceful || stopping {
+		p.setState(StateStopped)
+	} else {
+		p.setState(StateCrashed)
+	}
+
 	mapping := p.DataToMap()
 	mapping["success"] = graceful
 
-	processes := operations.GenerateProcess(p.RunData.Post, p.Environment, mapping, p.RunData.EnvironmentVariables)
+	processes, err := operations.GenerateProcess(p.RunData.Post, p.Environment, mapping, p.RunData.EnvironmentVariables)
+	if err != nil {
+		logging.Error("Error reading post execution steps of server "+p.Id(), err)
+		p.Environment.DisplayToConsole("Error executing post steps\n")
+		return
+	}
 
 	p.Environment.DisplayToConsole("Running post-execution steps\n")
 	logging.Debugf("Running post execution steps: %s", p.Id())
 
-	err := processes.Run(p.Environment)
+	err = processes.Run(p.Environment)
 	if err != nil {
 		logging.Error("Error running post processing")
 		p.Environment.DisplayToConsole("Error executing post steps\n")
 		return
 	}
 
-	if !p.RunData.AutoRestartFromCrash && !p.RunData.AutoRestartFromGraceful {
+	if stopping || (!p.RunData.AutoRestartFromCrash && !p.RunData.AutoRestartFromGraceful) {
 		return
 	}
 
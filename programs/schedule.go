@@ -0,0 +1,285 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/programs/operations"
+	"github.com/robfig/cron"
+	"time"
+)
+
+//Actions run on the server every time the cron expression matches
+type Schedule struct {
+	//Standard 5 field cron expression, or a descriptor such as @daily
+	Cron     string           `json:"cron"`
+	Disabled bool             `json:"disabled,omitempty"`
+	Actions  []ScheduleAction `json:"actions"`
+
+	status ScheduleStatus
+}
+
+type ScheduleAction struct {
+	//One of command, start, stop, restart, kill or operations
+	Type string `json:"type"`
+	//Console command, for the command type
+	Command string `json:"command,omitempty"`
+	//Operations to run, in the same form as the install section
+	Operations []map[string]interface{} `json:"operations,omitempty"`
+}
+
+type ScheduleStatus struct {
+	Running bool   `json:"running"`
+	LastRun int64  `json:"lastRun,omitempty"`
+	NextRun int64  `json:"nextRun,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+//A schedule with its status, as returned by the API
+type ScheduleInfo struct {
+	*Schedule
+	Status ScheduleStatus `json:"status"`
+}
+
+type scheduleJob struct {
+	program *ProgramData
+	name    string
+}
+
+func (j scheduleJob) Run() {
+	j.program.runSchedule(j.name)
+}
+
+//Checks the cron expression and actions of the schedule
+func (s *Schedule) validate() error {
+	_, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression: %s", err.Error())
+	}
+
+	if len(s.Actions) == 0 {
+		return errors.New("schedule has no actions")
+	}
+
+	for i, v := range s.Actions {
+		switch v.Type {
+		case "start", "stop", "restart", "kill":
+		case "command":
+			if v.Command == "" {
+				return fmt.Errorf("action %d has no command", i)
+			}
+		case "operations":
+			if len(v.Operations) == 0 {
+				return fmt.Errorf("action %d has no operations", i)
+			}
+		default:
+			return fmt.Errorf("action %d has unknown type %s", i, v.Type)
+		}
+	}
+	return nil
+}
+
+//Starts running the enabled schedules of the server, replacing any which were running
+func (p *ProgramData) StartScheduler() {
+	p.scheduleLocker.Lock()
+	defer p.scheduleLocker.Unlock()
+
+	if p.scheduler != nil {
+		p.scheduler.Stop()
+		p.scheduler = nil
+	}
+
+	scheduler := cron.New()
+	count := 0
+	for name, schedule := range p.Schedules {
+		if schedule.Disabled {
+			continue
+		}
+		parsed, err := cron.ParseStandard(schedule.Cron)
+		if err != nil {
+			logging.Errorf("Invalid cron expression for schedule %s of server %s: %s", name, p.Id(), err.Error())
+			continue
+		}
+		scheduler.Schedule(parsed, scheduleJob{program: p, name: name})
+		count++
+	}
+
+	if count > 0 {
+		scheduler.Start()
+		p.scheduler = scheduler
+	}
+}
+
+func (p *ProgramData) StopScheduler() {
+	p.scheduleLocker.Lock()
+	defer p.scheduleLocker.Unlock()
+
+	if p.scheduler != nil {
+		p.scheduler.Stop()
+		p.scheduler = nil
+	}
+}
+
+func (p *ProgramData) GetSchedules() map[string]ScheduleInfo {
+	p.scheduleLocker.Lock()
+	defer p.scheduleLocker.Unlock()
+
+	result := make(map[string]ScheduleInfo)
+	for name, schedule := range p.Schedules {
+		result[name] = ScheduleInfo{Schedule: schedule, Status: schedule.status}
+	}
+
+	if p.scheduler != nil {
+		for _, entry := range p.scheduler.Entries() {
+			job, ok := entry.Job.(scheduleJob)
+			if !ok {
+				continue
+			}
+			if info, ok := result[job.name]; ok {
+				info.Status.NextRun = entry.Next.Unix()
+				result[job.name] = info
+			}
+		}
+	}
+	return result
+}
+
+//Adds the schedule, replacing any with the same name, and saves the server
+func (p *ProgramData) SetSchedule(name string, schedule Schedule) (err error) {
+	if name == "" {
+		return errors.New("schedule name is required")
+	}
+	err = schedule.validate()
+	if err != nil {
+		return
+	}
+
+	p.scheduleLocker.Lock()
+	if p.Schedules == nil {
+		p.Schedules = make(map[string]*Schedule)
+	}
+	p.Schedules[name] = &schedule
+	p.scheduleLocker.Unlock()
+
+	p.StartScheduler()
+	return Save(p.Id())
+}
+
+func (p *ProgramData) DeleteSchedule(name string) (err error) {
+	p.scheduleLocker.Lock()
+	if _, ok := p.Schedules[name]; !ok {
+		p.scheduleLocker.Unlock()
+		return errors.New("no schedule with given name")
+	}
+	delete(p.Schedules, name)
+	p.scheduleLocker.Unlock()
+
+	p.StartScheduler()
+	return Save(p.Id())
+}
+
+//Runs the schedule now, in the background
+func (p *ProgramData) RunSchedule(name string) error {
+	p.scheduleLocker.Lock()
+	schedule, ok := p.Schedules[name]
+	running := ok && schedule.status.Running
+	p.scheduleLocker.Unlock()
+
+	if !ok {
+		return errors.New("no schedule with given name")
+	}
+	if running {
+		return errors.New("schedule is already running")
+	}
+
+	go p.runSchedule(name)
+	return nil
+}
+
+func (p *ProgramData) runSchedule(name string) {
+	p.scheduleLocker.Lock()
+	schedule, ok := p.Schedules[name]
+	if !ok || schedule.status.Running {
+		p.scheduleLocker.Unlock()
+		return
+	}
+	schedule.status.Running = true
+	schedule.status.LastRun = time.Now().Unix()
+	p.scheduleLocker.Unlock()
+
+	logging.Debugf("Running schedule %s of server %s", name, p.Id())
+	var err error
+	for _, action := range schedule.Actions {
+		err = p.runScheduleAction(action)
+		if err != nil {
+			break
+		}
+	}
+
+	p.scheduleLocker.Lock()
+	schedule.status.Running = false
+	schedule.status.Success = err == nil
+	schedule.status.Error = ""
+	if err != nil {
+		schedule.status.Error = err.Error()
+	}
+	p.scheduleLocker.Unlock()
+
+	if err != nil {
+		logging.Error(fmt.Sprintf("Error running schedule %s of server %s", name, p.Id()), err)
+	}
+}
+
+func (p *ProgramData) runScheduleAction(action ScheduleAction) (err error) {
+	switch action.Type {
+	case "command":
+		return p.Execute(action.Command)
+	case "start":
+		return p.Start()
+	case "stop":
+		running, err := p.IsRunning()
+		if err != nil || !running {
+			return err
+		}
+		_, err = p.StopAndWait()
+		return err
+	case "restart":
+		running, err := p.IsRunning()
+		if err != nil {
+			return err
+		}
+		if running {
+			_, err = p.StopAndWait()
+			if err != nil {
+				return err
+			}
+		}
+		return p.Start()
+	case "kill":
+		return p.Kill()
+	case "operations":
+		process, err := operations.GenerateProcess(action.Operations, p.Environment, p.DataToMap(), p.RunData.EnvironmentVariables)
+		if err != nil {
+			return err
+		}
+		return process.Run(p.Environment)
+	}
+	return fmt.Errorf("unknown action type %s", action.Type)
+}
@@ -0,0 +1,122 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"fmt"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/messages"
+)
+
+//Where a server is in its lifecycle
+type State string
+
+const (
+	StateStopped     State = "stopped"
+	StateInstalling  State = "installing"
+	StateDownloading State = "downloading"
+	StateStarting    State = "starting"
+	StateRunning     State = "running"
+	StateStopping    State = "stopping"
+	StateCrashed     State = "crashed"
+	StateErrored     State = "errored"
+)
+
+//The states each state may change to
+var stateTransitions = map[State][]State{
+	StateStopped:     {StateStarting, StateInstalling, StateDownloading},
+	StateCrashed:     {StateStarting, StateInstalling, StateDownloading, StateStopped},
+	StateErrored:     {StateStarting, StateInstalling, StateDownloading, StateStopped},
+	StateInstalling:  {StateStopped, StateErrored},
+	StateDownloading: {StateStopped, StateStarting, StateErrored},
+	StateStarting:    {StateRunning, StateDownloading, StateStopping, StateStopped, StateCrashed, StateErrored},
+	StateRunning:     {StateStopping, StateStopped, StateCrashed},
+	StateStopping:    {StateStopped, StateRunning},
+}
+
+func (p *ProgramData) GetState() State {
+	p.stateLocker.Lock()
+	defer p.stateLocker.Unlock()
+	return p.getState()
+}
+
+func (p *ProgramData) getState() State {
+	if p.state == "" {
+		return StateStopped
+	}
+	return p.state
+}
+
+//Changes the state if the current state allows it, and tells anyone watching the console
+func (p *ProgramData) setState(state State) error {
+	p.stateLocker.Lock()
+	defer p.stateLocker.Unlock()
+
+	previous := p.getState()
+	if previous == state {
+		return nil
+	}
+
+	allowed := false
+	for _, v := range stateTransitions[previous] {
+		if v == state {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("server is %s, cannot change to %s", previous, state)
+	}
+
+	p.changedState(previous, state)
+	return nil
+}
+
+//Changes the state only if it is still the expected one, for changes another may have overtaken,
+//such as a server exiting before it is marked as running
+func (p *ProgramData) compareAndSetState(expected, state State) bool {
+	p.stateLocker.Lock()
+	defer p.stateLocker.Unlock()
+
+	if p.getState() != expected {
+		return false
+	}
+	p.changedState(expected, state)
+	return true
+}
+
+func (p *ProgramData) changedState(previous, state State) {
+	logging.Debugf("Server %s changed from %s to %s", p.Id(), previous, state)
+	p.state = state
+	if p.Environment != nil {
+		p.Environment.BroadcastMessage(messages.StatusMessage{Status: string(state), Previous: string(previous)})
+	}
+}
+
+//Tracks image downloads done by the environment, returning to the previous state once it is done
+func (p *ProgramData) onDownload(downloading bool) {
+	if downloading {
+		previous := p.GetState()
+		if err := p.setState(StateDownloading); err != nil {
+			logging.Debugf("Not marking server %s as downloading: %s", p.Id(), err.Error())
+			return
+		}
+		p.stateBeforeDownload = previous
+	} else if p.GetState() == StateDownloading {
+		p.setState(p.stateBeforeDownload)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/pufferpanel/apufferi/http"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/backups"
+	"github.com/pufferpanel/pufferd/programs"
+	"io"
+)
+
+func CreateBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	_, wait := c.GetQuery("wait")
+
+	settings := prg.GetBackupSettings()
+	options := backups.Options{Stop: settings.Stop, SaveCommand: settings.SaveCommand, Incremental: settings.Incremental}
+	err := json.NewDecoder(c.Request.Body).Decode(&options)
+	if err != nil && err != io.EOF {
+		http.Respond(c).Status(400).Message("error parsing json").Data(err).Code(http.MALFORMEDJSON).Send()
+		return
+	}
+
+	manifest, err := backups.Create(prg, options, !wait)
+	if err == backups.ErrBackupRunning {
+		http.Respond(c).Status(409).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+
+	if wait {
+		http.Respond(c).Data(manifest).Send()
+	} else {
+		http.Respond(c).Status(202).Data(manifest).Send()
+	}
+}
+
+func GetBackups(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	result, err := backups.List(prg.Id())
+	if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Data(result).Send()
+}
+
+func DownloadBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	manifest, archive, err := backups.Get(prg.Id(), c.Param("backup"))
+	if err == backups.ErrNoBackup {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+prg.Id()+"-"+manifest.Id+".tar.gz\"")
+	if manifest.Format != backups.FormatSnapshot {
+		c.File(archive)
+		return
+	}
+
+	c.Header("Content-Type", "application/gzip")
+	c.Status(200)
+	err = backups.Export(prg.Id(), manifest.Id, c.Writer)
+	if err != nil {
+		logging.Error("Error exporting backup "+manifest.Id, err)
+	}
+}
+
+func DeleteBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	err := backups.Delete(prg.Id(), c.Param("backup"))
+	if err == backups.ErrNoBackup {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err == backups.ErrBackupRunning {
+		http.Respond(c).Status(409).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Send()
+}
+
+func RestoreBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	_, wait := c.GetQuery("wait")
+
+	err := backups.Restore(prg, c.Param("backup"), c.Query("file"), !wait)
+	if err == backups.ErrNoBackup || err == backups.ErrNoFile {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err == backups.ErrBackupRunning {
+		http.Respond(c).Status(409).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+
+	if wait {
+		http.Respond(c).Send()
+	} else {
+		http.Respond(c).Status(202).Send()
+	}
+}
+
+func VerifyBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	problems, err := backups.Verify(prg.Id(), c.Param("backup"))
+	if err == backups.ErrNoBackup {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Data(map[string]interface{}{"valid": len(problems) == 0, "errors": problems}).Send()
+}
+
+func PruneBackups(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	freed, err := backups.Prune(prg)
+	if err == backups.ErrBackupRunning {
+		http.Respond(c).Status(409).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Data(map[string]interface{}{"freed": freed}).Send()
+}
@@ -0,0 +1,125 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pufferpanel/apufferi/http"
+	"github.com/pufferpanel/pufferd/programs"
+)
+
+func InstallServer(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	job, err := prg.InstallJob()
+	respondJob(c, job, err)
+}
+
+func UninstallServer(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	job, err := prg.UninstallJob()
+	respondJob(c, job, err)
+}
+
+//Responds with the started job, or once it has finished if asked to wait
+func respondJob(c *gin.Context, job *programs.Job, err error) {
+	if err == programs.ErrJobRunning {
+		http.Respond(c).Status(409).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+
+	if _, wait := c.GetQuery("wait"); !wait {
+		http.Respond(c).Status(202).Data(job.GetStatus()).Send()
+		return
+	}
+
+	err = job.Wait()
+	status := job.GetStatus()
+	if err != nil {
+		http.Respond(c).Status(500).Message(status.Type + " " + status.Status).Data(status).Send()
+		return
+	}
+	http.Respond(c).Data(status).Send()
+}
+
+func GetJobs(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	jobs, err := prg.GetJobs()
+	if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Data(jobs).Send()
+}
+
+func GetJob(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	job, err := prg.GetJob(c.Param("job"))
+	if err == programs.ErrNoJob {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Data(job).Send()
+}
+
+func GetJobLog(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	log, err := prg.GetJobLog(c.Param("job"))
+	if err == programs.ErrNoJob {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.File(log)
+}
+
+func CancelJob(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	err := prg.CancelJob(c.Param("job"))
+	if err == programs.ErrNoJob {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err == programs.ErrJobNotRunning {
+		http.Respond(c).Status(409).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Send()
+}
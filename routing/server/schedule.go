@@ -0,0 +1,96 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/pufferpanel/apufferi/http"
+	"github.com/pufferpanel/pufferd/programs"
+)
+
+func GetSchedules(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	http.Respond(c).Data(prg.GetSchedules()).Send()
+}
+
+func GetSchedule(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	schedule, ok := prg.GetSchedules()[c.Param("name")]
+	if !ok {
+		http.Respond(c).Status(404).Message("no schedule with given name").Send()
+		return
+	}
+	http.Respond(c).Data(schedule).Send()
+}
+
+func PutSchedule(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	schedule := programs.Schedule{}
+	err := json.NewDecoder(c.Request.Body).Decode(&schedule)
+	if err != nil {
+		http.Respond(c).Status(400).Message("error parsing json").Data(err).Code(http.MALFORMEDJSON).Send()
+		return
+	}
+
+	err = prg.SetSchedule(c.Param("name"), schedule)
+	if err != nil {
+		http.Respond(c).Status(400).Message(err.Error()).Send()
+		return
+	}
+	http.Respond(c).Send()
+}
+
+func DeleteSchedule(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	if _, ok := prg.GetSchedules()[c.Param("name")]; !ok {
+		http.Respond(c).Status(404).Message("no schedule with given name").Send()
+		return
+	}
+
+	err := prg.DeleteSchedule(c.Param("name"))
+	if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	http.Respond(c).Send()
+}
+
+func RunSchedule(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	if _, ok := prg.GetSchedules()[c.Param("name")]; !ok {
+		http.Respond(c).Status(404).Message("no schedule with given name").Send()
+		return
+	}
+
+	err := prg.RunSchedule(c.Param("name"))
+	if err != nil {
+		http.Respond(c).Status(409).Message(err.Error()).Send()
+		return
+	}
+	http.Respond(c).Status(202).Send()
+}
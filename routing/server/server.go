@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -34,9 +35,12 @@ import (
 	"github.com/pufferpanel/apufferi/common"
 	"github.com/pufferpanel/apufferi/http"
 	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/consolelog"
+	"github.com/pufferpanel/pufferd/environments"
 	ppErrors "github.com/pufferpanel/pufferd/errors"
 	"github.com/pufferpanel/pufferd/httphandlers"
 	"github.com/pufferpanel/pufferd/programs"
+	"github.com/pufferpanel/pufferd/utils"
 
 	"github.com/pufferpanel/pufferd/messages"
 	"github.com/satori/go.uuid"
@@ -51,6 +55,11 @@ var wsupgrader = websocket.Upgrader{
 }
 
 func RegisterRoutes(e *gin.Engine) {
+	e.GET("/socket", httphandlers.OAuth2Handler("", false), cors.Middleware(cors.Config{
+		Origins:     "*",
+		Credentials: true,
+	}), OpenSocket)
+
 	l := e.Group("/server")
 	{
 		l.Handle("CONNECT", "/:id/console", func(c *gin.Context) {
@@ -62,6 +71,7 @@ func RegisterRoutes(e *gin.Engine) {
 		l.GET("/:id", httphandlers.OAuth2Handler("server.edit", true), GetServer)
 		l.POST("/:id", httphandlers.OAuth2Handler("server.edit", true), EditServer)
 		l.POST("/:id/reload", httphandlers.OAuth2Handler("server.edit", true), ReloadServer)
+		l.POST("/:id/resources", httphandlers.OAuth2Handler("server.edit", true), EditResources)
 
 		l.GET("/:id/start", httphandlers.OAuth2Handler("server.start", true), StartServer)
 		l.GET("/:id/stop", httphandlers.OAuth2Handler("server.stop", true), StopServer)
@@ -72,6 +82,11 @@ func RegisterRoutes(e *gin.Engine) {
 		l.POST("/:id/kill", httphandlers.OAuth2Handler("server.stop", true), KillServer)
 
 		l.POST("/:id/install", httphandlers.OAuth2Handler("server.install", true), InstallServer)
+		l.POST("/:id/uninstall", httphandlers.OAuth2Handler("server.install", true), UninstallServer)
+		l.GET("/:id/jobs", httphandlers.OAuth2Handler("server.install", true), GetJobs)
+		l.GET("/:id/jobs/:job", httphandlers.OAuth2Handler("server.install", true), GetJob)
+		l.GET("/:id/jobs/:job/log", httphandlers.OAuth2Handler("server.install", true), GetJobLog)
+		l.POST("/:id/jobs/:job/cancel", httphandlers.OAuth2Handler("server.install", true), CancelJob)
 
 		l.GET("/:id/file/*filename", httphandlers.OAuth2Handler("server.file.get", true), GetFile)
 		l.PUT("/:id/file/*filename", httphandlers.OAuth2Handler("server.file.put", true), PutFile)
@@ -82,10 +97,28 @@ func RegisterRoutes(e *gin.Engine) {
 			Origins:     "*",
 			Credentials: true,
 		}), GetConsole)
+		l.GET("/:id/terminal", httphandlers.OAuth2Handler("server.console.send", true), cors.Middleware(cors.Config{
+			Origins:     "*",
+			Credentials: true,
+		}), GetTerminal)
 		l.GET("/:id/logs", httphandlers.OAuth2Handler("server.console", true), GetLogs)
 
 		l.GET("/:id/stats", httphandlers.OAuth2Handler("server.stats", true), GetStats)
 		l.GET("/:id/status", httphandlers.OAuth2Handler("server.stats", true), GetStatus)
+
+		l.GET("/:id/schedules", httphandlers.OAuth2Handler("server.edit", true), GetSchedules)
+		l.GET("/:id/schedules/:name", httphandlers.OAuth2Handler("server.edit", true), GetSchedule)
+		l.PUT("/:id/schedules/:name", httphandlers.OAuth2Handler("server.edit", true), PutSchedule)
+		l.DELETE("/:id/schedules/:name", httphandlers.OAuth2Handler("server.edit", true), DeleteSchedule)
+		l.POST("/:id/schedules/:name/run", httphandlers.OAuth2Handler("server.edit", true), RunSchedule)
+
+		l.POST("/:id/backup", httphandlers.OAuth2Handler("server.edit", true), CreateBackup)
+		l.POST("/:id/backup/prune", httphandlers.OAuth2Handler("server.edit", true), PruneBackups)
+		l.GET("/:id/backups", httphandlers.OAuth2Handler("server.edit", true), GetBackups)
+		l.GET("/:id/backups/:backup", httphandlers.OAuth2Handler("server.edit", true), DownloadBackup)
+		l.DELETE("/:id/backups/:backup", httphandlers.OAuth2Handler("server.edit", true), DeleteBackup)
+		l.POST("/:id/backups/:backup/restore", httphandlers.OAuth2Handler("server.edit", true), RestoreBackup)
+		l.POST("/:id/backups/:backup/verify", httphandlers.OAuth2Handler("server.edit", true), VerifyBackup)
 	}
 	l.POST("", httphandlers.OAuth2Handler("server.create", false), CreateServer)
 	e.GET("/network", httphandlers.OAuth2Handler("server.network", false), NetworkServer)
@@ -109,20 +142,24 @@ func StopServer(c *gin.Context) {
 
 	_, wait := c.GetQuery("wait")
 
-	err := server.Stop()
-	if err != nil {
-		errorConnection(c, err)
-		return
-	}
-
-	if wait {
-		err = server.GetEnvironment().WaitForMainProcess()
+	if !wait {
+		err := server.Stop()
 		if err != nil {
 			errorConnection(c, err)
 			return
 		}
+		http.Respond(c).Send()
+		return
 	}
-	http.Respond(c).Send()
+
+	graceful, err := server.StopAndWait()
+	if err != nil {
+		errorConnection(c, err)
+		return
+	}
+	result := make(map[string]interface{})
+	result["graceful"] = graceful
+	http.Respond(c).Data(result).Send()
 }
 
 func KillServer(c *gin.Context) {
@@ -164,6 +201,12 @@ func CreateServer(c *gin.Context) {
 	environment := createData.EnvironmentData
 	typeServer := createData.Type
 
+	//the server would be written out but could not be loaded with limits which are not valid
+	if _, err = environments.ParseResourceLimits(environment); err != nil {
+		http.Respond(c).Status(400).Message(err.Error()).Send()
+		return
+	}
+
 	if !programs.Create(serverId, typeServer, data, environment) {
 		errorConnection(c, nil)
 	} else {
@@ -184,16 +227,6 @@ func DeleteServer(c *gin.Context) {
 	}
 }
 
-func InstallServer(c *gin.Context) {
-	item, _ := c.Get("server")
-	prg := item.(programs.Program)
-
-	go func() {
-		prg.Install()
-	}()
-	http.Respond(c).Send()
-}
-
 func EditServer(c *gin.Context) {
 	item, _ := c.Get("server")
 	prg := item.(programs.Program)
@@ -212,6 +245,27 @@ func EditServer(c *gin.Context) {
 	http.Respond(c).Send()
 }
 
+func EditResources(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(programs.Program)
+
+	data := make(map[string]interface{}, 0)
+	err := json.NewDecoder(c.Request.Body).Decode(&data)
+	if err != nil {
+		http.Respond(c).Status(400).Message("error parsing json").Data(err).Code(http.MALFORMEDJSON).Send()
+		return
+	}
+
+	err = prg.SetResourceLimits(data)
+	if _, invalid := err.(ppErrors.InvalidResourceLimits); invalid {
+		http.Respond(c).Status(400).Message(err.Error()).Send()
+	} else if err != nil {
+		http.Respond(c).Status(500).Data(err).Message("error updating resource limits").Send()
+	} else {
+		http.Respond(c).Send()
+	}
+}
+
 func ReloadServer(c *gin.Context) {
 	item, _ := c.Get("server")
 	prg := item.(programs.Program)
@@ -402,21 +456,42 @@ func PostConsole(c *gin.Context) {
 	}
 }
 
+//Opens the console socket of the server. With version=2 this speaks version 2 of the protocol, already subscribed to the server.
 func GetConsole(c *gin.Context) {
 	item, _ := c.Get("server")
 	program := item.(programs.Program)
 
-	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	ws, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		logging.Error("Error creating websocket", err)
 		errorConnection(c, err)
 		return
 	}
+	conn := utils.NewConnection(ws)
+
+	//clients which reconnect give the last line they saw, so they only get the lines they missed
+	after, _ := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+
+	if c.Query("version") == "2" {
+		s := newSocket(c, conn)
+		if err = s.subscribe(program.Id(), after); err != nil {
+			s.reply(socketRequest{Server: program.Id()}, err)
+		}
+		s.serve()
+		return
+	}
 
-	console, _ := program.GetEnvironment().GetConsole()
-	msg := messages.ConsoleMessage{Logs: console}
+	lines := program.GetEnvironment().GetConsoleLines(after)
+	logs := make([]string, len(lines))
+	for i, line := range lines {
+		logs[i] = line.Text()
+	}
+	msg := messages.ConsoleMessage{Logs: logs, Lines: lines}
 	conn.WriteJSON(&messages.Transmission{Message: msg, Type: msg.Key()})
 
+	status := messages.StatusMessage{Status: string(program.GetState())}
+	conn.WriteJSON(&messages.Transmission{Message: status, Type: status.Key()})
+
 	go listenOnSocket(conn, program)
 
 	program.GetEnvironment().AddListener(conn)
@@ -428,14 +503,11 @@ func GetStats(c *gin.Context) {
 
 	results, err := svr.GetEnvironment().GetStats()
 	if err != nil {
-		result := make(map[string]interface{})
-
 		_, isOffline := err.(ppErrors.ServerOffline)
 		if isOffline {
-			result["memory"] = 0
-			result["cpu"] = 0
-			http.Respond(c).Data(result).Status(200).Send()
+			http.Respond(c).Data(&messages.StatMessage{}).Status(200).Send()
 		} else {
+			result := make(map[string]interface{})
 			result["error"] = err.Error()
 			http.Respond(c).Data(result).Status(500).Send()
 		}
@@ -462,10 +534,20 @@ func NetworkServer(c *gin.Context) {
 	http.Respond(c).Data(result).Send()
 }
 
+//Gets the console output. Without any of the history parameters, this is the buffer since time.
+//Otherwise it is read from the console log: limit lines (100 by default) between the sequences given as after and before,
+//and between from and to in unix milliseconds, matching the search regex.
 func GetLogs(c *gin.Context) {
 	item, _ := c.Get("server")
 	program := item.(programs.Program)
 
+	for _, k := range []string{"before", "after", "from", "to", "search", "limit"} {
+		if _, ok := c.GetQuery(k); ok {
+			getLogHistory(c, program)
+			return
+		}
+	}
+
 	time := c.DefaultQuery("time", "0")
 
 	castedTime, ok := strconv.ParseInt(time, 10, 64)
@@ -487,6 +569,55 @@ func GetLogs(c *gin.Context) {
 	http.Respond(c).Data(result).Send()
 }
 
+func getLogHistory(c *gin.Context, program programs.Program) {
+	query := consolelog.Query{}
+	for k, v := range map[string]*int64{"before": &query.Before, "after": &query.After, "from": &query.From, "to": &query.To} {
+		value, err := strconv.ParseInt(c.DefaultQuery(k, "0"), 10, 64)
+		if err != nil || value < 0 {
+			http.Respond(c).Status(400).Message(k + " is not a valid number").Send()
+			return
+		}
+		*v = value
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		http.Respond(c).Status(400).Message("limit must be between 1 and 1000").Send()
+		return
+	}
+	query.Limit = limit
+
+	if search := c.Query("search"); search != "" {
+		query.Search, err = regexp.Compile(search)
+		if err != nil {
+			http.Respond(c).Status(400).Message("invalid search: " + err.Error()).Send()
+			return
+		}
+	}
+
+	history, err := program.GetEnvironment().GetConsoleHistory(query)
+	if err == consolelog.ErrDisabled {
+		http.Respond(c).Status(404).Message(err.Error()).Send()
+		return
+	} else if err != nil {
+		errorConnection(c, err)
+		return
+	}
+
+	msg := ""
+	for _, line := range history.Lines {
+		msg += line.Message + "\n"
+	}
+	result := make(map[string]interface{})
+	result["logs"] = msg
+	result["lines"] = history.Lines
+	result["more"] = history.More
+	if len(history.Lines) > 0 {
+		result["before"] = history.Lines[0].Sequence
+	}
+	http.Respond(c).Data(result).Send()
+}
+
 func GetStatus(c *gin.Context) {
 	item, _ := c.Get("server")
 	program := item.(programs.Program)
@@ -499,6 +630,7 @@ func GetStatus(c *gin.Context) {
 		http.Respond(c).Data(result).Status(500).Send()
 	} else {
 		result["running"] = running
+		result["status"] = program.GetState()
 		http.Respond(c).Data(result).Send()
 	}
 }
@@ -508,7 +640,8 @@ func errorConnection(c *gin.Context, err error) {
 	http.Respond(c).Status(500).Code(http.UNKNOWN).Data(err).Message("error handling request").Send()
 }
 
-func listenOnSocket(conn *websocket.Conn, server programs.Program) {
+func listenOnSocket(conn *utils.Connection, server programs.Program) {
+	defer conn.Close()
 	for {
 		msgType, data, err := conn.ReadMessage()
 		if err != nil {
@@ -531,17 +664,9 @@ func listenOnSocket(conn *websocket.Conn, server programs.Program) {
 			switch messageType.(string) {
 			case "statRequest":
 				{
-					results, err := server.GetEnvironment().GetStats()
-					msg := messages.StatMessage{}
-					if err != nil {
-						_, isOffline := err.(ppErrors.ServerOffline)
-						if isOffline {
-							msg.Cpu = 0
-							msg.Memory = 0
-						}
-					} else {
-						msg.Cpu, _ = results["cpu"].(float64)
-						msg.Memory, _ = results["memory"].(float64)
+					msg, err := server.GetEnvironment().GetStats()
+					if err != nil || msg == nil {
+						msg = &messages.StatMessage{}
 					}
 					conn.WriteJSON(&messages.Transmission{Message: msg, Type: msg.Key()})
 				}
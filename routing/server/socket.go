@@ -0,0 +1,270 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pufferpanel/apufferi/common"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/consolelog"
+	"github.com/pufferpanel/pufferd/messages"
+	"github.com/pufferpanel/pufferd/programs"
+	"github.com/pufferpanel/pufferd/utils"
+	"sync"
+)
+
+const protocolVersion = 2
+
+//The most lines read back from the console log for a client carrying on from the last line it saw
+const resumeLimit = 1000
+
+//A request from the client. Request is an id of the client's choosing, which is sent back with the result.
+//Types are subscribe (with after, the last sequence the client saw), unsubscribe, command, action (start, stop, kill or restart),
+//statRequest and ping. Each needs the scope it would need over http.
+type socketRequest struct {
+	Type    string `json:"type"`
+	Request string `json:"request"`
+	Server  string `json:"server"`
+	After   int64  `json:"after"`
+	Command string `json:"command"`
+	Action  string `json:"action"`
+}
+
+//A socket using version 2 of the protocol, which can listen to every server its token can access
+type socket struct {
+	conn       *utils.Connection
+	access     string
+	scopes     []string
+	subscribed map[string]programs.Program
+	locker     sync.Mutex
+}
+
+//Opens a socket which is not subscribed to any server yet
+func OpenSocket(c *gin.Context) {
+	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logging.Error("Error creating websocket", err)
+		errorConnection(c, err)
+		return
+	}
+	newSocket(c, utils.NewConnection(conn)).serve()
+}
+
+func newSocket(c *gin.Context, conn *utils.Connection) *socket {
+	access, _ := c.Get("server_id")
+	scopes, _ := c.Get("scopes")
+	s := &socket{conn: conn, subscribed: make(map[string]programs.Program)}
+	s.access, _ = access.(string)
+	s.scopes, _ = scopes.([]string)
+	return s
+}
+
+func (s *socket) serve() {
+	defer s.close()
+	s.send(messages.HelloMessage{Version: protocolVersion}, socketRequest{})
+
+	for {
+		msgType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logging.Error("error on websocket", err)
+			}
+			return
+		}
+		if msgType != websocket.TextMessage {
+			continue
+		}
+
+		request := socketRequest{}
+		err = json.Unmarshal(data, &request)
+		if err != nil {
+			s.reply(request, errors.New("invalid request"))
+			continue
+		}
+
+		switch request.Type {
+		case "subscribe":
+			s.reply(request, s.subscribe(request.Server, request.After))
+		case "unsubscribe":
+			s.reply(request, s.unsubscribe(request.Server))
+		case "command":
+			program, err := s.getServer(request.Server, "server.console.send")
+			if err == nil {
+				err = program.Execute(request.Command)
+			}
+			s.reply(request, err)
+		case "action":
+			//stopping can take a while, which should not hold up other requests
+			go func(request socketRequest) {
+				s.reply(request, s.runAction(request.Server, request.Action))
+			}(request)
+		case "statRequest":
+			program, err := s.getServer(request.Server, "server.stats")
+			if err != nil {
+				s.reply(request, err)
+				continue
+			}
+			msg, err := program.GetEnvironment().GetStats()
+			if err != nil || msg == nil {
+				msg = &messages.StatMessage{}
+			}
+			s.send(msg, request)
+		case "ping":
+			s.send(messages.PongMessage{}, request)
+		default:
+			s.reply(request, fmt.Errorf("unknown request type %s", request.Type))
+		}
+	}
+}
+
+//Gets the server, if the token can access it with the scope
+func (s *socket) getServer(id, scope string) (programs.Program, error) {
+	if !common.ContainsValue(s.scopes, scope) {
+		return nil, errors.New("missing scope " + scope)
+	}
+	if s.access != "*" && s.access != id {
+		return nil, errors.New("invalid server access")
+	}
+	program, _ := programs.Get(id)
+	if program == nil {
+		return nil, errors.New("no server with id " + id)
+	}
+	return program, nil
+}
+
+//Starts sending the console of the server, beginning with the lines after the sequence the client last saw.
+//The buffered lines are sent after subscribing so none are missed, so clients may see a line twice and should go by sequence.
+//Lines which are no longer buffered come from the console log, and the message is marked truncated if some could not be found.
+func (s *socket) subscribe(id string, after int64) error {
+	program, err := s.getServer(id, "server.console")
+	if err != nil {
+		return err
+	}
+
+	s.locker.Lock()
+	s.subscribed[id] = program
+	s.locker.Unlock()
+	program.GetEnvironment().AddListener(s.conn)
+
+	env := program.GetEnvironment()
+	lines := env.GetConsoleLines(after)
+	//the buffer only has the newest lines, and none after a restart, so older ones the client missed are read from the console log
+	truncated := false
+	if after > 0 && (len(lines) == 0 || lines[0].Sequence > after+1) {
+		query := consolelog.Query{After: after, Limit: resumeLimit}
+		if len(lines) > 0 {
+			query.Before = lines[0].Sequence
+		}
+		history, err := env.GetConsoleHistory(query)
+		if err == nil {
+			lines = append(history.Lines, lines...)
+		} else if err != consolelog.ErrDisabled {
+			logging.Error("Error reading console log", err)
+		}
+		truncated = len(lines) > 0 && lines[0].Sequence > after+1
+	}
+
+	logs := make([]string, len(lines))
+	for i, line := range lines {
+		logs[i] = line.Text()
+	}
+	request := socketRequest{Server: id}
+	s.send(messages.ConsoleMessage{Logs: logs, Lines: lines, Truncated: truncated}, request)
+	s.send(messages.StatusMessage{Status: string(program.GetState())}, request)
+	return nil
+}
+
+func (s *socket) unsubscribe(id string) error {
+	s.locker.Lock()
+	program, ok := s.subscribed[id]
+	delete(s.subscribed, id)
+	s.locker.Unlock()
+	if !ok {
+		return errors.New("not subscribed to " + id)
+	}
+	program.GetEnvironment().RemoveListener(s.conn)
+	return nil
+}
+
+func (s *socket) runAction(id, action string) error {
+	scopes := map[string][]string{
+		"start":   {"server.start"},
+		"stop":    {"server.stop"},
+		"kill":    {"server.stop"},
+		"restart": {"server.stop", "server.start"},
+	}[action]
+	if scopes == nil {
+		return fmt.Errorf("unknown action %s", action)
+	}
+
+	var program programs.Program
+	for _, scope := range scopes {
+		var err error
+		if program, err = s.getServer(id, scope); err != nil {
+			return err
+		}
+	}
+
+	switch action {
+	case "start":
+		return program.Start()
+	case "stop":
+		return program.Stop()
+	case "kill":
+		return program.Kill()
+	}
+
+	running, err := program.IsRunning()
+	if err != nil {
+		return err
+	}
+	if running {
+		if _, err = program.StopAndWait(); err != nil {
+			return err
+		}
+	}
+	return program.Start()
+}
+
+func (s *socket) reply(request socketRequest, err error) {
+	result := messages.ResultMessage{Success: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	s.send(result, request)
+}
+
+func (s *socket) send(msg messages.Message, request socketRequest) {
+	err := s.conn.WriteJSON(&messages.Transmission{Message: msg, Type: msg.Key(), Server: request.Server, Request: request.Request})
+	if err != nil {
+		logging.Debugf("Error writing to websocket: %s", err.Error())
+	}
+}
+
+func (s *socket) close() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for id, program := range s.subscribed {
+		program.GetEnvironment().RemoveListener(s.conn)
+		delete(s.subscribed, id)
+	}
+	s.conn.Close()
+}
@@ -0,0 +1,104 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pufferpanel/apufferi/http"
+	"github.com/pufferpanel/apufferi/logging"
+	"github.com/pufferpanel/pufferd/environments"
+	"github.com/pufferpanel/pufferd/messages"
+	"github.com/pufferpanel/pufferd/programs"
+	"github.com/pufferpanel/pufferd/utils"
+)
+
+//A text message on the terminal socket. Types are input (with data) and resize (with cols and rows).
+type terminalRequest struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+//Opens the terminal of the server, for environments which run in one.
+//Output is sent as binary messages as it comes, and binary messages are written to the terminal as they are.
+func GetTerminal(c *gin.Context) {
+	item, _ := c.Get("server")
+	program := item.(programs.Program)
+
+	terminal, ok := program.GetEnvironment().(environments.Terminal)
+	if !ok {
+		http.Respond(c).Status(400).Message("server does not run in a terminal").Send()
+		return
+	}
+
+	ws, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logging.Error("Error creating websocket", err)
+		errorConnection(c, err)
+		return
+	}
+	conn := utils.NewConnection(ws)
+	defer conn.Close()
+
+	terminal.AddTerminal(conn)
+	defer terminal.RemoveTerminal(conn)
+
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logging.Error("error on websocket", err)
+			}
+			return
+		}
+
+		if msgType == websocket.BinaryMessage {
+			err = terminal.WriteTerminal(data)
+		} else {
+			err = handleTerminalRequest(terminal, data)
+		}
+		if err != nil {
+			result := messages.ResultMessage{Error: err.Error()}
+			conn.WriteJSON(&messages.Transmission{Message: result, Type: result.Key(), Server: program.Id()})
+		}
+	}
+}
+
+func handleTerminalRequest(terminal environments.Terminal, data []byte) error {
+	request := terminalRequest{}
+	err := json.Unmarshal(data, &request)
+	if err != nil {
+		return errors.New("invalid request")
+	}
+
+	switch request.Type {
+	case "input":
+		return terminal.WriteTerminal([]byte(request.Data))
+	case "resize":
+		if request.Cols == 0 || request.Rows == 0 {
+			return errors.New("cols and rows must be greater than 0")
+		}
+		return terminal.ResizeTerminal(request.Cols, request.Rows)
+	default:
+		return fmt.Errorf("unknown request type %s", request.Type)
+	}
+}
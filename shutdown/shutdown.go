@@ -61,17 +61,20 @@ func Shutdown() *sync.WaitGroup {
 			if !running {
 				return
 			}
-			err = e.Stop()
-			if err != nil {
-				logging.Error("Error stopping server "+e.Id(), err)
+			if e.GetEnvironment().IsDetached() {
+				logging.Warn("Leaving detached program " + e.Id() + " running")
 				return
 			}
-			err = e.GetEnvironment().WaitForMainProcess()
+			graceful, err := e.StopAndWait()
 			if err != nil {
 				logging.Error("Error stopping server "+e.Id(), err)
 				return
 			}
-			logging.Warn("Stopped program " + e.Id())
+			if graceful {
+				logging.Warn("Stopped program " + e.Id())
+			} else {
+				logging.Warn("Killed program " + e.Id() + " as it did not stop in time")
+			}
 		}(element)
 	}
 	return &wg
@@ -0,0 +1,182 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/pufferpanel/apufferi/config"
+	"github.com/pufferpanel/apufferi/logging"
+	"sync"
+	"time"
+)
+
+const (
+	//how often sockets are pinged, which have to answer within pongWait or be closed
+	pingPeriod = 30 * time.Second
+	pongWait   = 60 * time.Second
+
+	//what happens to a socket which cannot keep up with its messages
+	SlowDrop       = "drop"
+	SlowDisconnect = "disconnect"
+)
+
+var ErrClosed = errors.New("connection is closed")
+var ErrSlow = errors.New("connection is too slow")
+
+//A websocket with its own queue of messages, which are written in order by a goroutine of their own.
+//A client which stops reading only fills its own queue, and once it is full either loses messages
+//or is disconnected, as websocketSlowClients says. A disconnected client can reconnect and carry on from the last line it saw.
+type Connection struct {
+	conn         *websocket.Conn
+	queue        chan queuedMessage
+	closed       chan struct{}
+	closeOnce    sync.Once
+	closeMessage []byte
+	writeTimeout time.Duration
+	dropSlow     bool
+}
+
+func NewConnection(conn *websocket.Conn) *Connection {
+	c := &Connection{
+		conn:         conn,
+		queue:        make(chan queuedMessage, config.GetIntOrDefault("websocketQueueSize", 256)),
+		closed:       make(chan struct{}),
+		writeTimeout: time.Duration(config.GetIntOrDefault("websocketWriteTimeout", 10)) * time.Second,
+		dropSlow:     config.GetStringOrDefault("websocketSlowClients", SlowDisconnect) == SlowDrop,
+	}
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go c.write()
+	return c
+}
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+}
+
+//Queues the text message to be sent, without waiting for it to be written
+func (c *Connection) Send(data []byte) error {
+	return c.queueMessage(queuedMessage{messageType: websocket.TextMessage, data: data})
+}
+
+//Queues the binary message to be sent, without waiting for it to be written
+func (c *Connection) SendBinary(data []byte) error {
+	return c.queueMessage(queuedMessage{messageType: websocket.BinaryMessage, data: data})
+}
+
+func (c *Connection) queueMessage(msg queuedMessage) error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case c.queue <- msg:
+		return nil
+	default:
+	}
+
+	if c.dropSlow {
+		return ErrSlow
+	}
+	//the writer sends the close message, so whoever is sending is never held up by the client
+	if c.markClosed(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow")) {
+		logging.Debugf("Closing websocket to %s, which is not reading its messages", c.conn.RemoteAddr())
+	}
+	return ErrSlow
+}
+
+func (c *Connection) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(data)
+}
+
+//Reads the next message. Only one goroutine may read from the connection.
+func (c *Connection) ReadMessage() (int, []byte, error) {
+	msgType, data, err := c.conn.ReadMessage()
+	if err == nil {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+	return msgType, data, err
+}
+
+func (c *Connection) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Connection) Close() error {
+	if !c.markClosed(nil) {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+//Stops any more messages from being queued, the writer sends the close message if there is one and closes the connection
+func (c *Connection) markClosed(closeMessage []byte) (marked bool) {
+	c.closeOnce.Do(func() {
+		c.closeMessage = closeMessage
+		close(c.closed)
+		marked = true
+	})
+	return
+}
+
+func (c *Connection) write() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	defer func() {
+		c.markClosed(nil)
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case <-c.closed:
+			if c.closeMessage != nil {
+				c.conn.WriteControl(websocket.CloseMessage, c.closeMessage, time.Now().Add(time.Second))
+			}
+			return
+		case msg := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			if err := c.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+				logging.Debugf("Error writing to websocket: %s", err.Error())
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout)); err != nil {
+				logging.Debugf("Error pinging websocket: %s", err.Error())
+				return
+			}
+		}
+	}
+}
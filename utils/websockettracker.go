@@ -20,55 +20,77 @@ import (
 	"encoding/json"
 	"github.com/pufferpanel/pufferd/messages"
 	"sync"
-
-	"github.com/gorilla/websocket"
 )
 
 type WebSocketManager interface {
-	Register(ws *websocket.Conn)
+	Register(ws *Connection)
+
+	//Stops sending messages to the socket
+	Unregister(ws *Connection)
 
 	Write(msg []byte) (n int, e error)
+
+	//Sends a message other than console output to every socket
+	WriteMessage(msg messages.Message)
 }
 
 type wsManager struct {
-	sockets []websocket.Conn
+	server  string
+	sockets []*Connection
 	locker  sync.Mutex
 }
 
-func CreateWSManager() WebSocketManager {
-	return &wsManager{sockets: make([]websocket.Conn, 0), locker: sync.Mutex{}}
+//Creates the manager for the sockets of a server, whose id is sent with every message so sockets can listen to several servers
+func CreateWSManager(server string) WebSocketManager {
+	return &wsManager{server: server, sockets: make([]*Connection, 0), locker: sync.Mutex{}}
 }
 
-func (ws *wsManager) Register(conn *websocket.Conn) {
-	ws.sockets = append(ws.sockets, *conn)
+func (ws *wsManager) Register(conn *Connection) {
+	ws.locker.Lock()
+	defer ws.locker.Unlock()
+	for _, v := range ws.sockets {
+		if v == conn {
+			return
+		}
+	}
+	ws.sockets = append(ws.sockets, conn)
 }
 
-func (ws *wsManager) Write(source []byte) (n int, e error) {
-	var msg = make([]byte, len(source))
-	copy(msg, source)
-
-	go func() {
-		ws.locker.Lock()
-		logs := make([]string, 1)
-		logs[0] = string(msg)
-		packet := messages.ConsoleMessage{Logs: logs}
-		data, _ := json.Marshal(&messages.Transmission{Message: packet, Type: packet.Key()})
-
-		for i := 0; i < len(ws.sockets); i++ {
-			socket := ws.sockets[i]
-			err := socket.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				if i+1 == len(ws.sockets) {
-					ws.sockets = ws.sockets[:i]
-				} else {
-					ws.sockets = append(ws.sockets[:i], ws.sockets[i+1:]...)
-				}
-				i--
-			}
+func (ws *wsManager) Unregister(conn *Connection) {
+	ws.locker.Lock()
+	defer ws.locker.Unlock()
+	for i, v := range ws.sockets {
+		if v == conn {
+			ws.sockets = append(ws.sockets[:i], ws.sockets[i+1:]...)
+			return
 		}
-		ws.locker.Unlock()
-	}()
+	}
+}
 
-	n = len(msg)
+func (ws *wsManager) Write(source []byte) (n int, e error) {
+	logs := make([]string, 1)
+	logs[0] = string(source)
+	ws.WriteMessage(messages.ConsoleMessage{Logs: logs})
+
+	n = len(source)
 	return
 }
+
+//Queues the message on every socket, in the order messages are written.
+//Sockets which are closed, or too slow and disconnected, are removed.
+func (ws *wsManager) WriteMessage(packet messages.Message) {
+	data, _ := json.Marshal(&messages.Transmission{Message: packet, Type: packet.Key(), Server: ws.server})
+
+	ws.locker.Lock()
+	defer ws.locker.Unlock()
+	sockets := ws.sockets[:0]
+	for _, socket := range ws.sockets {
+		if err := socket.Send(data); err != ErrClosed && !socket.IsClosed() {
+			sockets = append(sockets, socket)
+		}
+	}
+	for i := len(sockets); i < len(ws.sockets); i++ {
+		ws.sockets[i] = nil
+	}
+	ws.sockets = sockets
+}